@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records a privileged action, or an attempt at one.
+type AuditEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	ActorID   int64              `bson:"actor_id" json:"actor_id"`
+	ChatID    int64              `bson:"chat_id,omitempty" json:"chat_id,omitempty"`
+	Action    string             `bson:"action" json:"action"`
+	Target    string             `bson:"target,omitempty" json:"target,omitempty"`
+	Allowed   bool               `bson:"allowed" json:"allowed"`
+	Detail    string             `bson:"detail,omitempty" json:"detail,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// isFinanceAdmin reports whether the user may act on withdrawals and on
+// referrals held for review.
+func isFinanceAdmin(userID int64) bool {
+	return userID == OwnerID || containsInt64(FinanceAdmins, userID)
+}
+
+func (a *app) audit(actor *gotgbot.User, chatID int64, action, target string, allowed bool, detail string) {
+	entry := AuditEntry{
+		ActorID:   actor.Id,
+		ChatID:    chatID,
+		Action:    action,
+		Target:    target,
+		Allowed:   allowed,
+		Detail:    detail,
+		CreatedAt: time.Now(),
+	}
+
+	if !allowed {
+		log.Printf("Unauthorized %s on %s by %d (%s)", action, target, actor.Id, actor.Username)
+	}
+
+	if err := a.store.RecordAudit(entry); err != nil {
+		log.Printf("Failed to write audit entry: %v", err)
+	}
+}
+
+// requireFinanceAdmin answers the callback with an alert and audits the
+// attempt when the presser isn't a finance admin.
+func (a *app) requireFinanceAdmin(b *gotgbot.Bot, query *gotgbot.CallbackQuery, action, target string) bool {
+	var chatID int64
+	if query.Message != nil {
+		chatID = query.Message.GetChat().Id
+	}
+
+	if isFinanceAdmin(query.From.Id) {
+		return true
+	}
+
+	a.audit(&query.From, chatID, action, target, false, query.Data)
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text:      "⛔ You are not authorized to do this.",
+		ShowAlert: true,
+	})
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// userCallbackTTL is how long buttons bound to a user stay valid.
+const userCallbackTTL = 24 * time.Hour
+
+var (
+	ErrCallbackForged  = errors.New("callback data signature mismatch")
+	ErrCallbackExpired = errors.New("callback data expired")
+
+	callbackKey []byte
+)
+
+// setCallbackSecret derives the HMAC key used to sign callback data.
+func setCallbackSecret(secret string) {
+	key := sha256.Sum256([]byte("earnify-callback:" + secret))
+	callbackKey = key[:]
+}
+
+func callbackMAC(s string) string {
+	mac := hmac.New(sha256.New, callbackKey)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+}
+
+// signCallback appends an expiry and a truncated HMAC to payload, keeping the
+// result within Telegram's 64 byte callback data limit. A zero ttl never expires.
+func signCallback(payload string, ttl time.Duration) string {
+	exp := "0"
+	if ttl > 0 {
+		exp = strconv.FormatInt(time.Now().Add(ttl).Unix(), 36)
+	}
+
+	unsigned := payload + "." + exp
+	return unsigned + "." + callbackMAC(unsigned)
+}
+
+// verifyCallback checks data produced by signCallback and returns the
+// dot-separated payload fields.
+func verifyCallback(data string) ([]string, error) {
+	i := strings.LastIndexByte(data, '.')
+	if i < 0 {
+		return nil, ErrCallbackForged
+	}
+
+	unsigned, sig := data[:i], data[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(callbackMAC(unsigned))) {
+		return nil, ErrCallbackForged
+	}
+
+	j := strings.LastIndexByte(unsigned, '.')
+	if j < 0 {
+		return nil, ErrCallbackForged
+	}
+
+	payload, exp := unsigned[:j], unsigned[j+1:]
+	if exp != "0" {
+		expiry, err := strconv.ParseInt(exp, 36, 64)
+		if err != nil {
+			return nil, ErrCallbackForged
+		}
+		if time.Now().Unix() > expiry {
+			return nil, ErrCallbackExpired
+		}
+	}
+
+	return strings.Split(payload, "."), nil
+}
+
+// callbackArgs verifies the update's callback data, answering the query with
+// an alert when it is forged or expired.
+func callbackArgs(b *gotgbot.Bot, query *gotgbot.CallbackQuery) ([]string, bool) {
+	args, err := verifyCallback(query.Data)
+	if err == nil {
+		return args, true
+	}
+
+	text := "❌ Invalid callback data."
+	if errors.Is(err, ErrCallbackExpired) {
+		text = "⌛ This button has expired. Please use /start again."
+	}
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text:      text,
+		ShowAlert: true,
+	})
+	return nil, false
+}
+
+// userCallbackArgs is callbackArgs for buttons bound to a user. The user ID
+// argument must belong to whoever pressed the button.
+func userCallbackArgs(b *gotgbot.Bot, ctx *ext.Context) ([]string, bool) {
+	query := ctx.CallbackQuery
+	args, ok := callbackArgs(b, query)
+	if !ok {
+		return nil, false
+	}
+
+	if len(args) < 2 || stringToInt64(args[1]) != ctx.EffectiveUser.Id {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ This button isn't for you.",
+			ShowAlert: true,
+		})
+		return nil, false
+	}
+
+	return args, true
+}
+
+func userCallback(action string, userID int64) string {
+	return signCallback(action+"."+strconv.FormatInt(userID, 10), userCallbackTTL)
+}
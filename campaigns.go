@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// campaignPrefix marks /start arguments that name a campaign rather than a
+// referrer.
+const campaignPrefix = "c_"
+
+// campaignDateLayout is how campaign start and end dates are written, in UTC.
+const campaignDateLayout = "2006-01-02"
+
+var campaignCodePattern = regexp.MustCompile(`^[a-z0-9_]{2,30}$`)
+
+// Campaign is a time-boxed promotion reached through ?start=c_<code>.
+//
+// New users who sign up through it are paid Bonus, and when PartnerID is
+// set they count as that user's referrals, with every level of the referral
+// rewards multiplied by Multiplier. Campaigns accept signups from StartsAt
+// until EndsAt (when set) and stop at MaxSignups (when set).
+type Campaign struct {
+	Code       string    `bson:"_id" json:"_id"`
+	Name       string    `bson:"name,omitempty" json:"name,omitempty"`
+	Bonus      float64   `bson:"bonus,omitempty" json:"bonus,omitempty"`
+	Multiplier float64   `bson:"multiplier,omitempty" json:"multiplier,omitempty"`
+	PartnerID  int64     `bson:"partner_id,omitempty" json:"partner_id,omitempty"`
+	StartsAt   time.Time `bson:"starts_at" json:"starts_at"`
+	EndsAt     time.Time `bson:"ends_at,omitempty" json:"ends_at,omitempty"`
+	MaxSignups int       `bson:"max_signups,omitempty" json:"max_signups,omitempty"`
+	Signups    int       `bson:"signups" json:"signups"`
+	BonusPaid  float64   `bson:"bonus_paid" json:"bonus_paid"`
+	CreatedBy  int64     `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// active reports whether c accepts signups at now.
+func (c *Campaign) active(now time.Time) bool {
+	if now.Before(c.StartsAt) || (!c.EndsAt.IsZero() && !now.Before(c.EndsAt)) {
+		return false
+	}
+	return c.MaxSignups == 0 || c.Signups < c.MaxSignups
+}
+
+func (c *Campaign) multiplier() float64 {
+	if c.Multiplier <= 0 {
+		return 1
+	}
+	return c.Multiplier
+}
+
+func (c *Campaign) status(now time.Time) string {
+	switch {
+	case now.Before(c.StartsAt):
+		return "⏳ scheduled"
+	case c.MaxSignups > 0 && c.Signups >= c.MaxSignups:
+		return "🔒 full"
+	case !c.EndsAt.IsZero() && !now.Before(c.EndsAt):
+		return "🏁 ended"
+	default:
+		return "🟢 active"
+	}
+}
+
+// campaignCode returns the campaign an /start argument names, if any.
+func campaignCode(arg string) (string, bool) {
+	if len(arg) <= len(campaignPrefix) || !strings.EqualFold(arg[:len(campaignPrefix)], campaignPrefix) {
+		return "", false
+	}
+	return strings.ToLower(arg[len(campaignPrefix):]), true
+}
+
+// referralMultiplier is what referral rewards for r are multiplied by.
+func (a *app) referralMultiplier(r *Referral) float64 {
+	if r.Campaign == "" {
+		return 1
+	}
+	c, err := a.store.GetCampaign(r.Campaign)
+	if err != nil {
+		log.Printf("Failed to load campaign %s: %v", r.Campaign, err)
+		return 1
+	}
+	return c.multiplier()
+}
+
+// payCampaignBonus counts user's signup towards the campaign and credits the
+// signup bonus while the campaign has room.
+func (a *app) payCampaignBonus(b *gotgbot.Bot, user *gotgbot.User, c *Campaign) {
+	_, err := a.store.RecordCampaignSignup(c.Code, c.Bonus, time.Now())
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		_, _ = b.SendMessage(user.Id, "⌛ This promotion has just ended, so no signup bonus was paid.", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record campaign signup: %v", err)
+		return
+	}
+
+	if c.Bonus <= 0 {
+		return
+	}
+	_, err = a.creditBalance(user.Id, c.Bonus, TxCampaignBonus, 0, "campaign "+c.Code)
+	if err != nil {
+		log.Printf("Failed to pay campaign bonus to %d: %v", user.Id, err)
+		return
+	}
+	_, _ = b.SendMessage(user.Id, fmt.Sprintf(
+		"🎁 <b>Signup Bonus!</b>\n\nYou received <b>%s</b> for joining through %s.",
+		formatAmount(c.Bonus), html.EscapeString(c.displayName())), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+}
+
+func (c *Campaign) displayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Code
+}
+
+func campaignText(b *gotgbot.Bot, c *Campaign) string {
+	ends, limit := "never", "none"
+	if !c.EndsAt.IsZero() {
+		ends = c.EndsAt.UTC().Format(campaignDateLayout)
+	}
+	if c.MaxSignups > 0 {
+		limit = strconv.Itoa(c.MaxSignups)
+	}
+	partner := "none"
+	if c.PartnerID != 0 {
+		partner = strconv.FormatInt(c.PartnerID, 10)
+	}
+
+	return fmt.Sprintf(
+		"📣 <b>%s</b> (%s)\n"+
+			"🔗 https://t.me/%s?start=%s%s\n"+
+			"🎁 <b>Bonus:</b> %s · ✖️ <b>Multiplier:</b> %s · 🤝 <b>Partner:</b> %s\n"+
+			"📅 %s → %s\n"+
+			"👥 <b>Signups:</b> %d / %s · 💵 <b>Bonus Paid:</b> %s",
+		html.EscapeString(c.displayName()), c.status(time.Now()),
+		b.User.Username, campaignPrefix, c.Code,
+		formatAmount(c.Bonus), strconv.FormatFloat(c.multiplier(), 'f', -1, 64), partner,
+		c.StartsAt.UTC().Format(campaignDateLayout), ends,
+		c.Signups, limit, formatAmount(c.BonusPaid))
+}
+
+// parseCampaignOptions fills c from key=value arguments.
+func parseCampaignOptions(c *Campaign, args []string) error {
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", arg)
+		}
+
+		var err error
+		switch strings.ToLower(key) {
+		case "name":
+			c.Name = strings.ReplaceAll(value, "_", " ")
+		case "bonus":
+			c.Bonus, err = strconv.ParseFloat(value, 64)
+			if err == nil && c.Bonus < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "x":
+			c.Multiplier, err = strconv.ParseFloat(value, 64)
+			if err == nil && c.Multiplier <= 0 {
+				err = fmt.Errorf("must be greater than zero")
+			}
+		case "partner":
+			c.PartnerID, err = strconv.ParseInt(value, 10, 64)
+		case "cap":
+			c.MaxSignups, err = strconv.Atoi(value)
+			if err == nil && c.MaxSignups < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "from":
+			c.StartsAt, err = time.Parse(campaignDateLayout, value)
+		case "to":
+			// The end date is inclusive.
+			c.EndsAt, err = time.Parse(campaignDateLayout, value)
+			c.EndsAt = c.EndsAt.AddDate(0, 0, 1)
+		case "days":
+			var days int
+			days, err = strconv.Atoi(value)
+			if err == nil && days <= 0 {
+				err = fmt.Errorf("must be greater than zero")
+			}
+			c.EndsAt = c.StartsAt.AddDate(0, 0, days)
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+
+	if !c.EndsAt.IsZero() && !c.EndsAt.After(c.StartsAt) {
+		return fmt.Errorf("the campaign must end after it starts")
+	}
+	return nil
+}
+
+func (a *app) campaignCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if user.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	usage := "❌ Invalid arguments.\n\nUsage:\n" +
+		"<code>/campaign list</code>\n" +
+		"<code>/campaign add &lt;code&gt; [bonus=5] [x=2] [partner=&lt;user_id&gt;] [cap=100] [from=YYYY-MM-DD] [to=YYYY-MM-DD|days=3] [name=Weekend_Promo]</code>\n" +
+		"<code>/campaign stats &lt;code&gt;</code>\n" +
+		"<code>/campaign end &lt;code&gt;</code>"
+	args := ctx.Args()[1:]
+	if len(args) == 0 {
+		_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	opts := &gotgbot.SendMessageOpts{
+		ParseMode:          "HTML",
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{IsDisabled: true},
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		campaigns, err := a.store.Campaigns()
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Failed to load campaigns.\n\n"+CustomError(err).Error(), nil)
+			return err
+		}
+		if len(campaigns) == 0 {
+			_, _ = msg.Reply(b, "📣 No campaigns yet.", nil)
+			return nil
+		}
+
+		texts := make([]string, len(campaigns))
+		for i := range campaigns {
+			texts[i] = campaignText(b, &campaigns[i])
+		}
+		_, _ = msg.Reply(b, strings.Join(texts, "\n\n"), opts)
+		return nil
+
+	case "add":
+		if len(args) < 2 {
+			_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+
+		code := strings.ToLower(args[1])
+		if !campaignCodePattern.MatchString(code) {
+			_, _ = msg.Reply(b, "❌ Campaign codes are 2-30 letters, digits or underscores.", nil)
+			return nil
+		}
+		if _, err := a.store.GetCampaign(code); err == nil {
+			_, _ = msg.Reply(b, "❌ A campaign with that code already exists.", nil)
+			return nil
+		}
+
+		now := time.Now()
+		c := Campaign{Code: code, StartsAt: now, CreatedBy: user.Id, CreatedAt: now}
+		if err := parseCampaignOptions(&c, args[2:]); err != nil {
+			_, _ = msg.Reply(b, "❌ "+err.Error(), nil)
+			return nil
+		}
+		if c.PartnerID != 0 {
+			if _, err := a.store.GetUser(c.PartnerID); err != nil {
+				_, _ = msg.Reply(b, "❌ The partner must be a user of the bot.", nil)
+				return nil
+			}
+		}
+
+		if err := a.store.SaveCampaign(c); err != nil {
+			_, _ = msg.Reply(b, "❌ Failed to save the campaign.\n\n"+CustomError(err).Error(), nil)
+			return err
+		}
+		_, _ = msg.Reply(b, "✅ Campaign created.\n\n"+campaignText(b, &c), opts)
+		return nil
+
+	case "stats", "end":
+		if len(args) < 2 {
+			_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+
+		c, err := a.store.GetCampaign(strings.ToLower(args[1]))
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Campaign not found.", nil)
+			return nil
+		}
+
+		if strings.ToLower(args[0]) == "end" {
+			if err := a.store.EndCampaign(c.Code, time.Now()); err != nil {
+				_, _ = msg.Reply(b, "❌ Failed to end the campaign.\n\n"+CustomError(err).Error(), nil)
+				return err
+			}
+			if c, err = a.store.GetCampaign(c.Code); err != nil {
+				return err
+			}
+		}
+
+		_, _ = msg.Reply(b, campaignText(b, c), opts)
+		return nil
+
+	default:
+		_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// New users must answer the captcha within captchaTimeout. After
+// maxCaptchaFailures wrong answers they have to wait captchaLockout after
+// each further failure before trying again.
+const (
+	captchaTimeout     = 2 * time.Minute
+	maxCaptchaFailures = 3
+	captchaLockout     = time.Hour
+	captchaOptions     = 4
+)
+
+// CaptchaFailure tallies the wrong captcha answers of one Telegram user.
+type CaptchaFailure struct {
+	UserID       int64     `bson:"_id" json:"_id"`
+	Count        int       `bson:"count" json:"count"`
+	LastFailedAt time.Time `bson:"last_failed_at" json:"last_failed_at"`
+}
+
+// captchaChallenge is the captcha a new user is currently answering, along
+// with the /start arguments to register them with once they pass.
+type captchaChallenge struct {
+	id     string
+	answer int
+	args   []string
+}
+
+var (
+	pendingCaptchas   = make(map[int64]captchaChallenge)
+	pendingCaptchasMu sync.Mutex
+)
+
+func setPendingCaptcha(userID int64, c captchaChallenge) {
+	pendingCaptchasMu.Lock()
+	defer pendingCaptchasMu.Unlock()
+	pendingCaptchas[userID] = c
+}
+
+func takePendingCaptcha(userID int64) (captchaChallenge, bool) {
+	pendingCaptchasMu.Lock()
+	defer pendingCaptchasMu.Unlock()
+	c, ok := pendingCaptchas[userID]
+	delete(pendingCaptchas, userID)
+	return c, ok
+}
+
+// captchaLocked reports whether the user failed the captcha too often to try
+// again yet.
+func (a *app) captchaLocked(userID int64) bool {
+	f, err := a.store.CaptchaFailures(userID)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Failed to load captcha failures of %d: %v", userID, err)
+		}
+		return false
+	}
+	return f.Count >= maxCaptchaFailures && time.Since(f.LastFailedAt) < captchaLockout
+}
+
+// sendCaptcha asks userID a simple sum with one correct and several wrong
+// answers as buttons, and returns the conversation's next state.
+func sendCaptcha(b *gotgbot.Bot, userID int64, args []string) error {
+	x, y := rand.Intn(9)+1, rand.Intn(9)+1
+	c := captchaChallenge{
+		id:     strconv.FormatInt(rand.Int63n(1<<30), 36),
+		answer: x + y,
+		args:   args,
+	}
+
+	options := []int{c.answer}
+	seen := map[int]bool{c.answer: true}
+	for len(options) < captchaOptions {
+		option := rand.Intn(18) + 1
+		if !seen[option] {
+			seen[option] = true
+			options = append(options, option)
+		}
+	}
+	rand.Shuffle(len(options), func(i, j int) { options[i], options[j] = options[j], options[i] })
+
+	var row []gotgbot.InlineKeyboardButton
+	for _, option := range options {
+		payload := fmt.Sprintf("captcha.%d.%s.%d", userID, c.id, option)
+		row = append(row, gotgbot.InlineKeyboardButton{
+			Text:         strconv.Itoa(option),
+			CallbackData: signCallback(payload, captchaTimeout),
+		})
+	}
+
+	setPendingCaptcha(userID, c)
+	_, err := b.SendMessage(userID, fmt.Sprintf(
+		"🤖 <b>Quick check before we start</b>\n\n"+
+			"What is <b>%d + %d</b>?\n\n"+
+			"⏳ Answer within %d minutes.",
+		x, y, int(captchaTimeout.Minutes())), &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{row}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send captcha: %v", err)
+	}
+	return handlers.NextConversationState(CAPTCHA)
+}
+
+// captchaAnswer checks the pressed answer. Passing registers the user with
+// the arguments they first sent /start with.
+func (a *app) captchaAnswer(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	query := ctx.CallbackQuery
+
+	args, ok := userCallbackArgs(b, ctx)
+	if !ok || len(args) < 4 {
+		takePendingCaptcha(user.Id)
+		_, _, _ = msg.EditText(b, "⌛ <b>The captcha has expired.</b>\n\nSend /start to try again.", &gotgbot.EditMessageTextOpts{
+			ParseMode: "HTML",
+		})
+		return handlers.EndConversation()
+	}
+
+	c, ok := takePendingCaptcha(user.Id)
+	if !ok || c.id != args[2] {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "⌛ This captcha is no longer valid. Please use /start again.",
+			ShowAlert: true,
+		})
+		if ok {
+			setPendingCaptcha(user.Id, c)
+		}
+		return nil
+	}
+
+	if stringToInt64(args[3]) == int64(c.answer) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "✅ Verified!"})
+		_, _, _ = msg.EditText(b, "✅ <b>Verified!</b>", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		if err := a.register(b, msg, user, c.args); err != nil {
+			return err
+		}
+		return handlers.EndConversation()
+	}
+
+	f, err := a.store.RecordCaptchaFailure(user.Id, time.Now())
+	if err != nil {
+		log.Printf("Failed to record captcha failure: %v", err)
+	}
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Wrong answer."})
+
+	if f != nil && f.Count >= maxCaptchaFailures {
+		_, _ = b.SendMessage(LoggerID, fmt.Sprintf("🤖 User %d (%s) failed the captcha %d times.", user.Id, user.FirstName, f.Count), nil)
+		_, _, _ = msg.EditText(b, fmt.Sprintf(
+			"🚫 <b>Too many wrong answers.</b>\n\nPlease try again in %d minutes with /start.",
+			int(captchaLockout.Minutes())), &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+		return handlers.EndConversation()
+	}
+
+	_, _, _ = msg.EditText(b, "❌ <b>Wrong answer.</b> Here is another one.", &gotgbot.EditMessageTextOpts{ParseMode: "HTML"})
+	return sendCaptcha(b, user.Id, c.args)
+}
@@ -1,30 +1,139 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// User represents the structure of a user document in MongoDB
-type User struct {
-	ID            int64   `bson:"_id,omitempty" json:"_id,omitempty"`
-	Referrer      int64   `bson:"referrer,omitempty" json:"referrer,omitempty"`
-	ReferredUsers []int64 `bson:"referred_users,omitempty" json:"referred_users,omitempty"`
-	AccNo         int64   `bson:"acc_no,omitempty" json:"acc_no,omitempty"`
-	Balance       float64 `bson:"balance,omitempty" json:"balance,omitempty"`
+// mongoStore is the MongoDB implementation of Store.
+type mongoStore struct {
+	ctx    context.Context
+	client *mongo.Client
+
+	users       *mongo.Collection
+	txs         *mongo.Collection
+	withdrawals *mongo.Collection
+	audit       *mongo.Collection
+	fsub        *mongo.Collection
+	members     *mongo.Collection
+	invites     *mongo.Collection
+	requests    *mongo.Collection
+	settings    *mongo.Collection
+	referrals   *mongo.Collection
+	captchas    *mongo.Collection
+	campaigns   *mongo.Collection
+}
+
+// newMongoStore sets up the collections and their indexes. Balance changes
+// run in multi-document transactions, so it refuses to start against a
+// standalone server.
+func newMongoStore(ctx context.Context, client *mongo.Client, db *mongo.Database) (*mongoStore, error) {
+	if err := checkTransactionSupport(ctx, client); err != nil {
+		return nil, err
+	}
+
+	s := &mongoStore{
+		ctx:         ctx,
+		client:      client,
+		users:       db.Collection("users"),
+		txs:         db.Collection("transactions"),
+		withdrawals: db.Collection("withdrawals"),
+		audit:       db.Collection("audit_log"),
+		fsub:        db.Collection("fsub_channels"),
+		members:     db.Collection("membership_events"),
+		invites:     db.Collection("invite_links"),
+		requests:    db.Collection("join_requests"),
+		settings:    db.Collection("settings"),
+		referrals:   db.Collection("referrals"),
+		captchas:    db.Collection("captcha_failures"),
+		campaigns:   db.Collection("campaigns"),
+	}
+
+	_, err := s.txs.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transactions index: %v", err)
+	}
+
+	_, err = s.withdrawals.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create withdrawals index: %v", err)
+	}
+
+	_, err = s.members.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create membership events index: %v", err)
+	}
+
+	_, err = s.invites.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "chat_id", Value: 1}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite links index: %v", err)
+	}
+
+	_, err = s.requests.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "chat_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create join requests index: %v", err)
+	}
+
+	_, err = s.users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ref_code", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "vanity_code", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "hide_from_top", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create users index: %v", err)
+	}
+
+	_, err = s.referrals.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "qualifies_at", Value: 1}}},
+		{Keys: bson.D{{Key: "referrer_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "settled_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create referrals index: %v", err)
+	}
+
+	return s, nil
+}
+
+// checkTransactionSupport fails unless the server is a replica set member or
+// a mongos router, the deployments that support transactions.
+func checkTransactionSupport(ctx context.Context, client *mongo.Client) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello)
+	if err != nil {
+		return fmt.Errorf("failed to check the MongoDB deployment: %v", err)
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("MongoDB must run as a replica set or sharded cluster because balance changes use transactions")
+	}
+	return nil
 }
 
-var userColl *mongo.Collection
+func (s *mongoStore) withTransaction(fn func(sc mongo.SessionContext) (interface{}, error)) (interface{}, error) {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start session: %v", err)
+	}
+	defer session.EndSession(s.ctx)
 
-func addUser(user User) error {
-	filter := bson.M{"$or": []bson.M{
-		{"_id": user.ID},
-	}}
+	return session.WithTransaction(s.ctx, fn)
+}
 
-	count, err := userColl.CountDocuments(ctx, filter)
+func (s *mongoStore) addUser(ctx context.Context, user User) error {
+	count, err := s.users.CountDocuments(ctx, bson.M{"_id": user.ID})
 	if err != nil {
 		return fmt.Errorf("failed to check user existence: %v", err)
 	}
@@ -33,7 +142,7 @@ func addUser(user User) error {
 		return fmt.Errorf("user with ID %d already exists", user.ID)
 	}
 
-	_, err = userColl.InsertOne(ctx, user)
+	_, err = s.users.InsertOne(ctx, user)
 	if err != nil {
 		return fmt.Errorf("failed to add user: %v", err)
 	}
@@ -41,118 +150,706 @@ func addUser(user User) error {
 	return nil
 }
 
-func referUser(referrerID, newUserID int64) error {
-	// Check if referrer exists
-	referrer := User{}
-	err := userColl.FindOne(ctx, bson.M{"_id": referrerID}).Decode(&referrer)
+func (s *mongoStore) AddUser(user User) error {
+	return s.addUser(s.ctx, user)
+}
+
+func (s *mongoStore) ReferUser(referrerID, newUserID int64) error {
+	_, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		// Check if referrer exists
+		count, err := s.users.CountDocuments(sc, bson.M{"_id": referrerID})
+		if err != nil || count == 0 {
+			return nil, fmt.Errorf("referrer with ID %d does not exist", referrerID)
+		}
+
+		err = s.addUser(sc, User{
+			ID:       newUserID,
+			Referrer: referrerID,
+			Balance:  0,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.users.UpdateOne(sc, bson.M{"_id": referrerID}, bson.M{"$push": bson.M{"referred_users": newUserID}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to update referrer's referred users: %v", err)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+func (s *mongoStore) HoldReferralReward(refereeID, referrerID int64, amount float64, entry Transaction) (*Transaction, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		hold := bson.M{"reward_hold": entry.Type}
+		if entry.Type == TxReferralFreeze {
+			hold["frozen_reward"] = amount
+		}
+		filter := bson.M{"_id": refereeID, "reward_hold": bson.M{"$exists": false}}
+		res, err := s.users.UpdateOne(sc, filter, bson.M{"$set": hold})
+		if err != nil {
+			return nil, fmt.Errorf("failed to hold the referral reward for user %d: %v", refereeID, err)
+		}
+		if res.MatchedCount == 0 {
+			return nil, mongo.ErrNoDocuments
+		}
+
+		debit := bson.M{"_id": referrerID, "balance": bson.M{"$gte": amount}}
+		return s.applyDeltaInSession(sc, referrerID, -amount, debit, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*Transaction), nil
+}
+
+func (s *mongoStore) ReleaseReferralReward(refereeID, referrerID int64, entry Transaction) (*Transaction, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		filter := bson.M{"_id": refereeID, "reward_hold": TxReferralFreeze}
+		update := bson.M{"$unset": bson.M{"reward_hold": "", "frozen_reward": ""}}
+		var referee User
+		if err := s.users.FindOneAndUpdate(sc, filter, update).Decode(&referee); err != nil {
+			return nil, err
+		}
+
+		return s.applyDeltaInSession(sc, referrerID, referee.FrozenReward, bson.M{"_id": referrerID}, entry)
+	})
 	if err != nil {
-		return fmt.Errorf("referrer with ID %d does not exist", referrerID)
+		return nil, err
 	}
 
-	newUser := User{
-		ID:       newUserID,
-		Referrer: referrerID,
-		Balance:  0,
+	return result.(*Transaction), nil
+}
+
+func (s *mongoStore) GetUser(userID int64) (*User, error) {
+	user := User{}
+	err := s.users.FindOne(s.ctx, bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		return nil, err
 	}
+	return &user, nil
+}
 
-	err = addUser(newUser)
+func (s *mongoStore) UpdateAccNo(userID int64, accNo int64) error {
+	_, err := s.users.UpdateOne(s.ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"acc_no": accNo}})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update acc_no for user %d: %v", userID, err)
 	}
+	return nil
+}
 
-	_, err = userColl.UpdateOne(ctx, bson.M{"_id": referrerID}, bson.M{"$push": bson.M{"referred_users": newUserID}})
+func (s *mongoStore) TouchUser(userID int64, at time.Time) error {
+	_, err := s.users.UpdateOne(s.ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"last_active_at": at}})
 	if err != nil {
-		return fmt.Errorf("failed to update referrer's referred users: %v", err)
+		return fmt.Errorf("failed to update activity of user %d: %v", userID, err)
 	}
 	return nil
 }
 
-func getUser(userID int64) (*User, error) {
-	user := User{}
-	err := userColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+func (s *mongoStore) SetRefCode(userID int64, code string) error {
+	return s.setUserCode(userID, "ref_code", code)
+}
+
+func (s *mongoStore) SetVanityCode(userID int64, code string) error {
+	return s.setUserCode(userID, "vanity_code", code)
+}
+
+func (s *mongoStore) setUserCode(userID int64, field, code string) error {
+	_, err := s.users.UpdateOne(s.ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{field: code}})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCodeTaken
+	}
 	if err != nil {
+		return fmt.Errorf("failed to update %s for user %d: %v", field, userID, err)
+	}
+	return nil
+}
+
+func (s *mongoStore) UserByCode(code string) (*User, error) {
+	user := User{}
+	filter := bson.M{"$or": bson.A{bson.M{"ref_code": code}, bson.M{"vanity_code": code}}}
+	if err := s.users.FindOne(s.ctx, filter).Decode(&user); err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-// // Retrieve all users referred by a specific user
-// func getReferredUsers(referrerID int64) ([]User, error) {
-// 	// Fetch the referrer's referred_users list
-// 	referrer, err := getUser(referrerID)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	// Fetch details of all referred users
-// 	filter := bson.M{"_id": bson.M{"$in": referrer.ReferredUsers}}
-// 	cursor, err := userColl.Find(ctx, filter)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("failed to retrieve referred users: %v", err)
-// 	}
-// 	defer cursor.Close(ctx)
+func (s *mongoStore) ClaimMilestone(userID int64, referrals int, bonus float64, entry Transaction) (*Transaction, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		filter := bson.M{"_id": userID, "milestones": bson.M{"$ne": referrals}}
+		res, err := s.users.UpdateOne(sc, filter, bson.M{"$push": bson.M{"milestones": referrals}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim milestone %d for user %d: %v", referrals, userID, err)
+		}
+		if res.MatchedCount == 0 {
+			return nil, mongo.ErrNoDocuments
+		}
+		return s.applyDeltaInSession(sc, userID, bonus, bson.M{"_id": userID}, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-// 	var referredUsers []User
-// 	if err = cursor.All(ctx, &referredUsers); err != nil {
-// 		return nil, fmt.Errorf("failed to decode referred users: %v", err)
-// 	}
-// 	return referredUsers, nil
-// }
+	return result.(*Transaction), nil
+}
 
-func updateUserBalance(userID int64, amount float64) error {
-	_, err := userColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$inc": bson.M{"balance": amount}})
+func (s *mongoStore) SetHideFromTop(userID int64, hide bool) error {
+	update := bson.M{"$set": bson.M{"hide_from_top": true}}
+	if !hide {
+		update = bson.M{"$unset": bson.M{"hide_from_top": ""}}
+	}
+	_, err := s.users.UpdateOne(s.ctx, bson.M{"_id": userID}, update)
 	if err != nil {
-		return fmt.Errorf("failed to update balance for user %d: %v", userID, err)
+		return fmt.Errorf("failed to update leaderboard visibility of user %d: %v", userID, err)
 	}
 	return nil
 }
 
-func removeBalance(userID int64, amount float64) (float64, error) {
-	if amount <= 0 {
-		return 0, fmt.Errorf("amount to remove must be greater than zero")
+func (s *mongoStore) UsersHiddenFromTop() ([]int64, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := s.users.Find(s.ctx, bson.M{"hide_from_top": true}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve hidden users: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var users []User
+	if err = cursor.All(s.ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode hidden users: %v", err)
+	}
+
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	return ids, nil
+}
+
+func (s *mongoStore) GetAllUsers() ([]User, error) {
+	cursor, err := s.users.Find(s.ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve users: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var users []User
+	if err = cursor.All(s.ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %v", err)
+	}
+	return users, nil
+}
+
+func (s *mongoStore) Credit(userID int64, amount float64, entry Transaction) (*Transaction, error) {
+	return s.applyDelta(userID, amount, bson.M{"_id": userID}, entry)
+}
+
+func (s *mongoStore) Debit(userID int64, amount float64, entry Transaction) (*Transaction, error) {
+	filter := bson.M{"_id": userID, "balance": bson.M{"$gte": amount}}
+	return s.applyDelta(userID, -amount, filter, entry)
+}
+
+// applyDelta runs the conditional balance update and the ledger insert in a
+// single session transaction, so either both are written or neither is.
+func (s *mongoStore) applyDelta(userID int64, delta float64, filter bson.M, entry Transaction) (*Transaction, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		return s.applyDeltaInSession(sc, userID, delta, filter, entry)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	filter := bson.M{"_id": userID}
-	update := bson.M{"$inc": bson.M{"balance": -amount}}
-	options := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	return result.(*Transaction), nil
+}
+
+func (s *mongoStore) applyDeltaInSession(sc mongo.SessionContext, userID int64, delta float64, filter bson.M, entry Transaction) (*Transaction, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 	var updatedUser User
-	err := userColl.FindOneAndUpdate(ctx, filter, update, options).Decode(&updatedUser)
+	err := s.users.FindOneAndUpdate(sc, filter, bson.M{"$inc": bson.M{"balance": delta}}, opts).Decode(&updatedUser)
+	if err == mongo.ErrNoDocuments {
+		count, err := s.users.CountDocuments(sc, bson.M{"_id": userID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check user existence: %v", err)
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("user with ID %d does not exist", userID)
+		}
+		return nil, fmt.Errorf("%w for user %d", ErrInsufficientBalance, userID)
+	}
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return 0, fmt.Errorf("user with ID %d does not exist", userID)
+		return nil, fmt.Errorf("failed to update balance for user %d: %v", userID, err)
+	}
+
+	entry.UserID = userID
+	entry.Amount = delta
+	entry.BalanceBefore = updatedUser.Balance - delta
+	entry.BalanceAfter = updatedUser.Balance
+	return s.recordTransaction(sc, entry)
+}
+
+func (s *mongoStore) recordTransaction(ctx context.Context, entry Transaction) (*Transaction, error) {
+	entry.CreatedAt = time.Now()
+	res, err := s.txs.InsertOne(ctx, entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transaction for user %d: %v", entry.UserID, err)
+	}
+
+	entry.ID, _ = res.InsertedID.(primitive.ObjectID)
+	return &entry, nil
+}
+
+func (s *mongoStore) RecordTransaction(entry Transaction) (*Transaction, error) {
+	return s.recordTransaction(s.ctx, entry)
+}
+
+func (s *mongoStore) transactions(ctx context.Context, userID int64) ([]Transaction, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cursor, err := s.txs.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve transactions: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var txs []Transaction
+	if err = cursor.All(ctx, &txs); err != nil {
+		return nil, fmt.Errorf("failed to decode transactions: %v", err)
+	}
+	return txs, nil
+}
+
+func (s *mongoStore) Transactions(userID int64) ([]Transaction, error) {
+	return s.transactions(s.ctx, userID)
+}
+
+func (s *mongoStore) RebuildBalance(userID int64) (float64, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		txs, err := s.transactions(sc, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		balance := ledgerBalance(txs)
+		res, err := s.users.UpdateOne(sc, bson.M{"_id": userID}, bson.M{"$set": bson.M{"balance": balance}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild balance for user %d: %v", userID, err)
 		}
-		return 0, fmt.Errorf("failed to update balance: %v", err)
+		if res.MatchedCount == 0 {
+			return nil, fmt.Errorf("user with ID %d does not exist", userID)
+		}
+		return balance, nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	if updatedUser.Balance < 0 {
-		_, rollbackErr := userColl.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance": amount}})
-		if rollbackErr != nil {
-			return 0, fmt.Errorf("balance went negative, rollback failed: %v", rollbackErr)
+	return result.(float64), nil
+}
+
+func (s *mongoStore) CreateWithdrawal(w Withdrawal) (*Withdrawal, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		filter := bson.M{"_id": w.UserID, "balance": bson.M{"$gte": w.Amount}}
+		entry := Transaction{Type: TxWithdrawal, ActorID: w.UserID, Reason: "withdrawal " + w.ID.Hex()}
+		tx, err := s.applyDeltaInSession(sc, w.UserID, -w.Amount, filter, entry)
+		if err != nil {
+			return nil, err
 		}
-		return 0, fmt.Errorf("insufficient balance for user %d", userID)
+
+		w.DebitTxID = tx.ID
+		if _, err := s.withdrawals.InsertOne(sc, w); err != nil {
+			return nil, fmt.Errorf("failed to store withdrawal: %v", err)
+		}
+		return &w, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return updatedUser.Balance, nil
+	return result.(*Withdrawal), nil
 }
 
-func updateUserAccNo(userID int64, accNo int64) error {
-	_, err := userColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"acc_no": accNo}})
+func (s *mongoStore) GetWithdrawal(id primitive.ObjectID) (*Withdrawal, error) {
+	w := Withdrawal{}
+	err := s.withdrawals.FindOne(s.ctx, bson.M{"_id": id}).Decode(&w)
 	if err != nil {
-		return fmt.Errorf("failed to update acc_no for user %d: %v", userID, err)
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (s *mongoStore) TransitionWithdrawal(id primitive.ObjectID, to string, actorID int64, reason string) (*Withdrawal, error) {
+	result, err := s.withTransaction(func(sc mongo.SessionContext) (interface{}, error) {
+		now := time.Now()
+		filter := bson.M{"_id": id, "status": bson.M{"$in": withdrawalTransitions[to]}}
+		update := bson.M{
+			"$set":  bson.M{"status": to, "acted_by": actorID, "reason": reason, "updated_at": now},
+			"$push": bson.M{"history": WithdrawalEvent{Status: to, ActorID: actorID, Reason: reason, At: now}},
+		}
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		var w Withdrawal
+		err := s.withdrawals.FindOneAndUpdate(sc, filter, update, opts).Decode(&w)
+		if err == mongo.ErrNoDocuments {
+			current := Withdrawal{}
+			if err := s.withdrawals.FindOne(sc, bson.M{"_id": id}).Decode(&current); err != nil {
+				return nil, fmt.Errorf("withdrawal %s does not exist", id.Hex())
+			}
+			return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, current.Status, to)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update withdrawal %s: %v", id.Hex(), err)
+		}
+
+		if !refundStates[to] {
+			return &w, nil
+		}
+
+		entry := Transaction{Type: TxRefund, ActorID: actorID, Reason: "refund withdrawal " + id.Hex()}
+		tx, err := s.applyDeltaInSession(sc, w.UserID, w.Amount, bson.M{"_id": w.UserID}, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		w.RefundTxID = tx.ID
+		if _, err := s.withdrawals.UpdateOne(sc, bson.M{"_id": id}, bson.M{"$set": bson.M{"refund_tx_id": tx.ID}}); err != nil {
+			return nil, fmt.Errorf("failed to link refund to withdrawal %s: %v", id.Hex(), err)
+		}
+		return &w, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*Withdrawal), nil
+}
+
+func (s *mongoStore) RecordAudit(entry AuditEntry) error {
+	if _, err := s.audit.InsertOne(s.ctx, entry); err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
 	}
 	return nil
 }
 
-func getAllUsers() ([]User, error) {
-	cursor, err := userColl.Find(ctx, bson.M{})
+func (s *mongoStore) FSubChannels() ([]FSubChannel, error) {
+	opts := options.Find().SetSort(bson.M{"added_at": 1})
+	cursor, err := s.fsub.Find(s.ctx, bson.M{}, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve users: %v", err)
+		return nil, fmt.Errorf("failed to retrieve fsub channels: %v", err)
 	}
-	defer cursor.Close(ctx)
+	defer cursor.Close(s.ctx)
 
-	var users []User
-	if err = cursor.All(ctx, &users); err != nil {
-		return nil, fmt.Errorf("failed to decode users: %v", err)
+	var channels []FSubChannel
+	if err = cursor.All(s.ctx, &channels); err != nil {
+		return nil, fmt.Errorf("failed to decode fsub channels: %v", err)
 	}
-	return users, nil
+	return channels, nil
+}
+
+func (s *mongoStore) AddFSubChannel(ch FSubChannel) error {
+	opts := options.Replace().SetUpsert(true)
+	if _, err := s.fsub.ReplaceOne(s.ctx, bson.M{"_id": ch.ID}, ch, opts); err != nil {
+		return fmt.Errorf("failed to add fsub channel %d: %v", ch.ID, err)
+	}
+	return nil
+}
+
+func (s *mongoStore) RemoveFSubChannel(chatID int64) error {
+	res, err := s.fsub.DeleteOne(s.ctx, bson.M{"_id": chatID})
+	if err != nil {
+		return fmt.Errorf("failed to remove fsub channel %d: %v", chatID, err)
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("channel %d is not a force-subscribe channel", chatID)
+	}
+	return nil
+}
+
+func (s *mongoStore) RecordMembershipEvent(event MembershipEvent) error {
+	if _, err := s.members.InsertOne(s.ctx, event); err != nil {
+		return fmt.Errorf("failed to record membership event: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) MembershipEvents(userID int64) ([]MembershipEvent, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cursor, err := s.members.Find(s.ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve membership events: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var events []MembershipEvent
+	if err = cursor.All(s.ctx, &events); err != nil {
+		return nil, fmt.Errorf("failed to decode membership events: %v", err)
+	}
+	return events, nil
+}
+
+func (s *mongoStore) SaveInviteLink(invite ReferralInvite) error {
+	if _, err := s.invites.InsertOne(s.ctx, invite); err != nil {
+		return fmt.Errorf("failed to save invite link: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) InviteLink(link string) (*ReferralInvite, error) {
+	var invite ReferralInvite
+	if err := s.invites.FindOne(s.ctx, bson.M{"_id": link}).Decode(&invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *mongoStore) FindInviteLink(chatID, ownerID int64, campaign string, joinRequest bool) (*ReferralInvite, error) {
+	filter := bson.M{"chat_id": chatID, "owner_id": ownerID, "campaign": campaign, "join_request": joinRequest}
+	if !joinRequest {
+		filter["join_request"] = bson.M{"$ne": true}
+	}
+	if ownerID == 0 {
+		filter["owner_id"] = bson.M{"$exists": false}
+	}
+	if campaign == "" {
+		filter["campaign"] = bson.M{"$exists": false}
+	}
+
+	var invite ReferralInvite
+	if err := s.invites.FindOne(s.ctx, filter).Decode(&invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *mongoStore) InviteLinksByOwner(ownerID int64) ([]ReferralInvite, error) {
+	cursor, err := s.invites.Find(s.ctx, bson.M{"owner_id": ownerID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve invite links: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var invites []ReferralInvite
+	if err = cursor.All(s.ctx, &invites); err != nil {
+		return nil, fmt.Errorf("failed to decode invite links: %v", err)
+	}
+	return invites, nil
+}
+
+func (s *mongoStore) IncrementInviteJoins(link string) error {
+	_, err := s.invites.UpdateOne(s.ctx, bson.M{"_id": link}, bson.M{"$inc": bson.M{"joins": 1}})
+	if err != nil {
+		return fmt.Errorf("failed to count invite join: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) SaveJoinRequest(req JoinRequest) error {
+	filter := bson.M{"chat_id": req.ChatID, "user_id": req.UserID}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := s.requests.ReplaceOne(s.ctx, filter, req, opts); err != nil {
+		return fmt.Errorf("failed to save join request: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) JoinRequest(chatID, userID int64) (*JoinRequest, error) {
+	var req JoinRequest
+	err := s.requests.FindOne(s.ctx, bson.M{"chat_id": chatID, "user_id": userID}).Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *mongoStore) DeleteJoinRequest(chatID, userID int64) error {
+	if _, err := s.requests.DeleteOne(s.ctx, bson.M{"chat_id": chatID, "user_id": userID}); err != nil {
+		return fmt.Errorf("failed to delete join request: %v", err)
+	}
+	return nil
+}
+
+// settingsID is the _id of the single settings document.
+const settingsID = "bot"
+
+func (s *mongoStore) GetSettings() (*Settings, error) {
+	var settings Settings
+	if err := s.settings.FindOne(s.ctx, bson.M{"_id": settingsID}).Decode(&settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (s *mongoStore) SaveSettings(settings Settings) error {
+	opts := options.Replace().SetUpsert(true)
+	if _, err := s.settings.ReplaceOne(s.ctx, bson.M{"_id": settingsID}, settings, opts); err != nil {
+		return fmt.Errorf("failed to save settings: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStore) CreateReferral(r Referral) (*Referral, error) {
+	r.ID = primitive.NewObjectID()
+	if _, err := s.referrals.InsertOne(s.ctx, r); err != nil {
+		return nil, fmt.Errorf("failed to create referral: %v", err)
+	}
+	return &r, nil
+}
+
+func (s *mongoStore) GetReferral(id primitive.ObjectID) (*Referral, error) {
+	r := Referral{}
+	if err := s.referrals.FindOne(s.ctx, bson.M{"_id": id}).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *mongoStore) TransitionReferral(id primitive.ObjectID, from, to, reason string) error {
+	filter := bson.M{"_id": id, "status": from}
+	update := bson.M{"$set": bson.M{"status": to, "reason": reason, "settled_at": time.Now()}}
+	res, err := s.referrals.UpdateOne(s.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to update referral %s: %v", id.Hex(), err)
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (s *mongoStore) FlagReferral(id primitive.ObjectID, score int, signals []string) error {
+	update := bson.M{"$set": bson.M{"fraud_score": score, "fraud_signals": signals}}
+	if _, err := s.referrals.UpdateOne(s.ctx, bson.M{"_id": id}, update); err != nil {
+		return fmt.Errorf("failed to flag referral %s: %v", id.Hex(), err)
+	}
+	return nil
+}
+
+func (s *mongoStore) DueReferrals(now time.Time) ([]Referral, error) {
+	filter := bson.M{"status": ReferralPending, "qualifies_at": bson.M{"$lte": now}}
+	return s.findReferrals(filter)
+}
+
+func (s *mongoStore) ReferralsByReferrer(referrerID int64) ([]Referral, error) {
+	return s.findReferrals(bson.M{"referrer_id": referrerID})
+}
+
+func (s *mongoStore) ReferralsByStatus(status string) ([]Referral, error) {
+	return s.findReferrals(bson.M{"status": status})
+}
+
+func (s *mongoStore) ReferrerRanks(since time.Time) ([]leaderRank, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": ReferralConfirmed, "settled_at": bson.M{"$gte": since}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$referrer_id", "referrals": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "referrals", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := s.referrals.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank referrers: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var ranks []leaderRank
+	if err = cursor.All(s.ctx, &ranks); err != nil {
+		return nil, fmt.Errorf("failed to decode referrer ranks: %v", err)
+	}
+	return ranks, nil
+}
+
+func (s *mongoStore) findReferrals(filter bson.M) ([]Referral, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cursor, err := s.referrals.Find(s.ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve referrals: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var referrals []Referral
+	if err = cursor.All(s.ctx, &referrals); err != nil {
+		return nil, fmt.Errorf("failed to decode referrals: %v", err)
+	}
+	return referrals, nil
+}
+
+func (s *mongoStore) RecordCaptchaFailure(userID int64, at time.Time) (*CaptchaFailure, error) {
+	update := bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"last_failed_at": at}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	f := CaptchaFailure{}
+	if err := s.captchas.FindOneAndUpdate(s.ctx, bson.M{"_id": userID}, update, opts).Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to record captcha failure of %d: %v", userID, err)
+	}
+	return &f, nil
+}
+
+func (s *mongoStore) CaptchaFailures(userID int64) (*CaptchaFailure, error) {
+	f := CaptchaFailure{}
+	if err := s.captchas.FindOne(s.ctx, bson.M{"_id": userID}).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (s *mongoStore) SaveCampaign(c Campaign) error {
+	opts := options.Replace().SetUpsert(true)
+	if _, err := s.campaigns.ReplaceOne(s.ctx, bson.M{"_id": c.Code}, c, opts); err != nil {
+		return fmt.Errorf("failed to save campaign %s: %v", c.Code, err)
+	}
+	return nil
+}
+
+func (s *mongoStore) GetCampaign(code string) (*Campaign, error) {
+	c := Campaign{}
+	if err := s.campaigns.FindOne(s.ctx, bson.M{"_id": code}).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *mongoStore) Campaigns() ([]Campaign, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := s.campaigns.Find(s.ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve campaigns: %v", err)
+	}
+	defer cursor.Close(s.ctx)
+
+	var campaigns []Campaign
+	if err = cursor.All(s.ctx, &campaigns); err != nil {
+		return nil, fmt.Errorf("failed to decode campaigns: %v", err)
+	}
+	return campaigns, nil
+}
+
+func (s *mongoStore) EndCampaign(code string, at time.Time) error {
+	update := bson.A{bson.M{"$set": bson.M{
+		"ends_at":   at,
+		"starts_at": bson.M{"$min": bson.A{"$starts_at", at}},
+	}}}
+	res, err := s.campaigns.UpdateOne(s.ctx, bson.M{"_id": code}, update)
+	if err != nil {
+		return fmt.Errorf("failed to end campaign %s: %v", code, err)
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (s *mongoStore) RecordCampaignSignup(code string, bonus float64, now time.Time) (*Campaign, error) {
+	filter := bson.M{
+		"_id":       code,
+		"starts_at": bson.M{"$lte": now},
+		"$and": bson.A{
+			bson.M{"$or": bson.A{bson.M{"ends_at": bson.M{"$exists": false}}, bson.M{"ends_at": bson.M{"$gt": now}}}},
+			bson.M{"$or": bson.A{bson.M{"max_signups": bson.M{"$exists": false}}, bson.M{"$expr": bson.M{"$lt": bson.A{"$signups", "$max_signups"}}}}},
+		},
+	}
+	update := bson.M{"$inc": bson.M{"signups": 1, "bonus_paid": bonus}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	c := Campaign{}
+	if err := s.campaigns.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Fraud signal weights. A referral scoring fraudReviewScore or more is held
+// for admin review instead of being paid automatically.
+const (
+	fraudReviewScore = 50
+
+	scoreNoUsername = 20
+	scoreNoLanguage = 15
+	scoreNoPhoto    = 20
+	scoreBurst      = 30
+	scoreInactive   = 25
+	scoreCaptcha    = 15
+)
+
+// A referrer signing up burstReferrals or more referees within burstWindow
+// looks like a referral farm.
+const (
+	burstReferrals = 5
+	burstWindow    = time.Hour
+)
+
+// activityWriteInterval throttles how often a user's last activity is saved.
+const activityWriteInterval = 10 * time.Minute
+
+var (
+	ErrSelfReferral     = errors.New("users can't refer themselves")
+	ErrCircularReferral = errors.New("circular referral")
+
+	activityWritten      = make(map[int64]time.Time)
+	activityWrittenMutex sync.Mutex
+)
+
+// checkReferralChain rejects self referrals and referrer chains that lead
+// back to the referee.
+func (a *app) checkReferralChain(refereeID, referrerID int64) error {
+	if refereeID == referrerID {
+		return ErrSelfReferral
+	}
+
+	visited := map[int64]bool{}
+	for current := referrerID; current != 0 && !visited[current]; {
+		if current == refereeID {
+			return ErrCircularReferral
+		}
+		visited[current] = true
+
+		u, err := a.store.GetUser(current)
+		if err != nil {
+			return nil
+		}
+		current = u.Referrer
+	}
+	return nil
+}
+
+// signupSignals scores a new referee on what the bot can see at sign-up.
+func (a *app) signupSignals(b *gotgbot.Bot, referee *gotgbot.User, referrerID int64) (int, []string) {
+	var score int
+	var signals []string
+	add := func(points int, signal string) {
+		score += points
+		signals = append(signals, signal)
+	}
+
+	if referee.Username == "" {
+		add(scoreNoUsername, "no username")
+	}
+	if referee.LanguageCode == "" {
+		add(scoreNoLanguage, "no language")
+	}
+
+	botAPILimiter.Wait()
+	photos, err := b.GetUserProfilePhotos(referee.Id, &gotgbot.GetUserProfilePhotosOpts{Limit: 1})
+	if err != nil {
+		log.Printf("Failed to get profile photos of %d: %v", referee.Id, err)
+	} else if photos.TotalCount == 0 {
+		add(scoreNoPhoto, "no profile photo")
+	}
+
+	if f, err := a.store.CaptchaFailures(referee.Id); err == nil && f.Count > 0 {
+		add(scoreCaptcha, fmt.Sprintf("failed the captcha %d times", f.Count))
+	}
+
+	referrals, err := a.store.ReferralsByReferrer(referrerID)
+	if err != nil {
+		log.Printf("Failed to load referrals of %d: %v", referrerID, err)
+	}
+	var recent int
+	for _, r := range referrals {
+		if time.Since(r.CreatedAt) < burstWindow {
+			recent++
+		}
+	}
+	if recent+1 >= burstReferrals {
+		add(scoreBurst, fmt.Sprintf("%d sign-ups under the referrer within an hour", recent+1))
+	}
+
+	return score, signals
+}
+
+// inactivitySignal flags referees who never came back after signing up.
+// It only applies once the hold gave them time to do so.
+func (a *app) inactivitySignal(r *Referral) (int, string) {
+	if r.QualifiesAt.Sub(r.CreatedAt) < activityWriteInterval {
+		return 0, ""
+	}
+
+	referee, err := a.store.GetUser(r.RefereeID)
+	if err != nil || referee.LastActiveAt.After(r.CreatedAt.Add(activityWriteInterval)) {
+		return 0, ""
+	}
+	return scoreInactive, "never used the bot again"
+}
+
+// trackActivity records when a user last interacted with the bot. It runs
+// ahead of every other handler and never stops the update.
+func (a *app) trackActivity(_ *gotgbot.Bot, ctx *ext.Context) error {
+	user := ctx.EffectiveUser
+	if user == nil {
+		return nil
+	}
+
+	now := time.Now()
+	activityWrittenMutex.Lock()
+	if now.Sub(activityWritten[user.Id]) < activityWriteInterval {
+		activityWrittenMutex.Unlock()
+		return nil
+	}
+	activityWritten[user.Id] = now
+	activityWrittenMutex.Unlock()
+
+	if err := a.store.TouchUser(user.Id, now); err != nil {
+		log.Printf("Failed to record activity of %d: %v", user.Id, err)
+	}
+	return nil
+}
+
+func reviewText(r *Referral) string {
+	return fmt.Sprintf(
+		"🚩 <b>Referral Held for Review</b>\n\n"+
+			"🆔 <b>Referral:</b> <code>%s</code>\n"+
+			"👤 <b>Referee:</b> %s (<code>%d</code>)\n"+
+			"🔗 <b>Referrer:</b> <code>%d</code>\n"+
+			"📊 <b>Score:</b> %d\n"+
+			"⚠️ <b>Signals:</b> %s",
+		r.ID.Hex(), html.EscapeString(r.RefereeName), r.RefereeID, r.ReferrerID, r.FraudScore,
+		html.EscapeString(strings.Join(r.FraudSignals, ", ")))
+}
+
+func reviewMarkup(r *Referral) gotgbot.InlineKeyboardMarkup {
+	return gotgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+			{Text: "✅ Approve", CallbackData: signCallback("review_ok."+r.ID.Hex(), 0)},
+			{Text: "❌ Reject", CallbackData: signCallback("review_no."+r.ID.Hex(), 0)},
+		}},
+	}
+}
+
+// holdForReview moves r into the review queue, posts it to the logger chat
+// and lets the referrer know.
+func (a *app) holdForReview(b *gotgbot.Bot, r *Referral, score int, signals []string) error {
+	if err := a.store.FlagReferral(r.ID, score, signals); err != nil {
+		return err
+	}
+
+	err := a.store.TransitionReferral(r.ID, ReferralPending, ReferralReview, "")
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.Status, r.FraudScore, r.FraudSignals = ReferralReview, score, signals
+	_, _ = b.SendMessage(LoggerID, reviewText(r), &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: reviewMarkup(r),
+	})
+
+	_, _ = b.SendMessage(r.ReferrerID, fmt.Sprintf(
+		"🔎 <b>Referral Under Review</b>\n\n"+
+			"👤 <b>%s</b> (%d) needs a manual check before your reward is credited.",
+		html.EscapeString(r.RefereeName), r.RefereeID), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
+
+// reviewCmd shows the oldest referral waiting for review.
+func (a *app) reviewCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if !isFinanceAdmin(ctx.EffectiveUser.Id) {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	queue, err := a.store.ReferralsByStatus(ReferralReview)
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to load the review queue.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+	if len(queue) == 0 {
+		_, _ = msg.Reply(b, "✅ No referrals are waiting for review.", nil)
+		return nil
+	}
+
+	text := fmt.Sprintf("📋 <b>%d referral(s) waiting for review</b>\n\n%s", len(queue), reviewText(&queue[0]))
+	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: reviewMarkup(&queue[0]),
+	})
+	return nil
+}
+
+// reviewCallback approves or rejects a referral from the review queue.
+func (a *app) reviewCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.CallbackQuery
+
+	args, ok := callbackArgs(b, query)
+	if !ok || len(args) < 2 {
+		return nil
+	}
+
+	approve := args[0] == "review_ok"
+	action := "reject_referral"
+	if approve {
+		action = "approve_referral"
+	}
+	if !a.requireFinanceAdmin(b, query, action, args[1]) {
+		return nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[1])
+	if err != nil {
+		return nil
+	}
+
+	r, err := a.store.GetReferral(id)
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Referral not found.", ShowAlert: true})
+		return nil
+	}
+
+	to, reason := ReferralRejected, "rejected by an admin"
+	if approve {
+		to, reason = ReferralConfirmed, "approved by an admin"
+	}
+
+	err = a.store.TransitionReferral(id, ReferralReview, to, reason)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "⚠️ This referral has already been reviewed.", ShowAlert: true})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reviewCallback: %v", err)
+	}
+
+	a.audit(&query.From, msg.Chat.Id, action, args[1], true, "")
+
+	if approve {
+		a.payReferralRewards(b, &gotgbot.User{Id: r.RefereeID, FirstName: r.RefereeName}, r.ReferrerID, a.referralMultiplier(r))
+	} else {
+		_, _ = b.SendMessage(r.ReferrerID, fmt.Sprintf(
+			"❌ <b>Referral Not Rewarded</b>\n\n"+
+				"👤 <b>%s</b> (%d) was rejected after review.",
+			html.EscapeString(r.RefereeName), r.RefereeID), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	}
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "✅ Referral " + to + "."})
+	_, _, _ = msg.EditText(b, fmt.Sprintf("%s\n\n📌 <b>Status:</b> %s by %s", reviewText(r), to, html.EscapeString(query.From.FirstName)), &gotgbot.EditMessageTextOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
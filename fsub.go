@@ -1,29 +1,143 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 )
 
+// FSubChannel is a force-subscribe channel added at runtime with /fsub.
+type FSubChannel struct {
+	ID      int64     `bson:"_id" json:"_id"`
+	Title   string    `bson:"title,omitempty" json:"title,omitempty"`
+	AddedBy int64     `bson:"added_by" json:"added_by"`
+	AddedAt time.Time `bson:"added_at" json:"added_at"`
+}
+
 var (
-	chatInviteLinks = make(map[int64]string)
+	chatInviteLinks = make(map[int64]inviteLinkEntry)
 	chatCacheMutex  sync.RWMutex
 	memberStatuses  = map[string]bool{
 		"member":        true,
 		"administrator": true,
 		"creator":       true,
 	}
+
+	// runtimeFSubIds are the channels stored in MongoDB, enforced on top of FSubIds.
+	runtimeFSubIds []int64
+	fsubIdsMutex   sync.RWMutex
+
+	// memberCache remembers confirmed memberships until they expire.
+	memberCache      = make(map[memberKey]time.Time)
+	memberCacheMutex sync.Mutex
+
+	// fsubExemptCommands can be used without joining the channels.
+	fsubExemptCommands = map[string]bool{
+		"help":   true,
+		"cancel": true,
+	}
+)
+
+// inviteLinkTTL is how long a channel invite link is reused before it is
+// fetched again, so revoked links recover on their own.
+const inviteLinkTTL = 6 * time.Hour
+
+// inviteLinkReportInterval throttles invite link failure reports per chat.
+const inviteLinkReportInterval = 10 * time.Minute
+
+var (
+	inviteLinkReported    = make(map[int64]time.Time)
+	inviteLinkReportMutex sync.Mutex
 )
 
-func retryMarkup(b *gotgbot.Bot, args, link string) *gotgbot.InlineKeyboardMarkup {
-	buttons := [][]gotgbot.InlineKeyboardButton{
-		{
-			{Text: "Jᴏɪɴ", Url: link},
-		},
+type inviteLinkEntry struct {
+	link    string
+	expires time.Time
+}
+
+// botAPILimiter is shared by every membership check so that parallel checks
+// from many users stay within Telegram's rate limits.
+var botAPILimiter = newRateLimiter(25)
+
+// memberCacheTTL is how long a confirmed membership is trusted before
+// GetChatMember is asked again. Non-members are never cached, so joining
+// takes effect on the next tap.
+const memberCacheTTL = 2 * time.Minute
+
+type memberKey struct {
+	chatID int64
+	userID int64
+}
+
+// fsubChannels returns every channel users must join: the ones configured
+// through FSUB_IDS followed by the ones added with /fsub.
+func fsubChannels() []int64 {
+	fsubIdsMutex.RLock()
+	defer fsubIdsMutex.RUnlock()
+
+	chats := append([]int64(nil), FSubIds...)
+	for _, id := range runtimeFSubIds {
+		if !containsInt64(chats, id) {
+			chats = append(chats, id)
+		}
+	}
+	return chats
+}
+
+// reloadFSubChannels reads the runtime channel list from the store and drops
+// cached invite links so they are fetched again for the new list.
+func (a *app) reloadFSubChannels() error {
+	channels, err := a.store.FSubChannels()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(channels))
+	for _, ch := range channels {
+		ids = append(ids, ch.ID)
+	}
+
+	fsubIdsMutex.Lock()
+	runtimeFSubIds = ids
+	fsubIdsMutex.Unlock()
+
+	invalidateInviteLinks(0)
+	return nil
+}
+
+// resolveChat looks up a chat by numeric ID or @username.
+func resolveChat(b *gotgbot.Bot, ref string) (*gotgbot.ChatFullInfo, error) {
+	raw, err := b.Request("getChat", map[string]string{"chat_id": ref}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var chat gotgbot.ChatFullInfo
+	if err := json.Unmarshal(raw, &chat); err != nil {
+		return nil, fmt.Errorf("failed to decode chat: %v", err)
+	}
+	return &chat, nil
+}
+
+// retryMarkup builds one join button per channel link, followed by a
+// "Try again" button that restarts the bot with the same arguments.
+func retryMarkup(b *gotgbot.Bot, args string, links []string) *gotgbot.InlineKeyboardMarkup {
+	var buttons [][]gotgbot.InlineKeyboardButton
+	for i, link := range links {
+		text := "Jᴏɪɴ"
+		if len(links) > 1 {
+			text = fmt.Sprintf("Jᴏɪɴ %d", i+1)
+		}
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+			{Text: text, Url: link},
+		})
 	}
 
 	if args != "" {
@@ -37,65 +151,407 @@ func retryMarkup(b *gotgbot.Bot, args, link string) *gotgbot.InlineKeyboardMarku
 	}
 }
 
+// fetchInviteLink returns a cached invite link for chatID, or asks Telegram
+// for one: a join-request link in join-request mode, otherwise the chat's
+// primary link, exporting a new one if the chat has none.
 func fetchInviteLink(b *gotgbot.Bot, chatID int64) (string, error) {
 	chatCacheMutex.RLock()
-	if link, found := chatInviteLinks[chatID]; found {
+	if entry, found := chatInviteLinks[chatID]; found && time.Now().Before(entry.expires) {
 		chatCacheMutex.RUnlock()
-		return link, nil
+		return entry.link, nil
 	}
 	chatCacheMutex.RUnlock()
 
 	chatCacheMutex.Lock()
 	defer chatCacheMutex.Unlock()
 
-	if link, found := chatInviteLinks[chatID]; found {
-		return link, nil
+	if entry, found := chatInviteLinks[chatID]; found && time.Now().Before(entry.expires) {
+		return entry.link, nil
 	}
 
-	chat, err := b.GetChat(chatID, nil)
+	link, err := newInviteLink(b, chatID)
 	if err != nil {
-		log.Printf("Error getting chat: %s", err)
+		reportInviteLinkFailure(b, chatID, err)
 		return "", err
 	}
 
-	chatInviteLinks[chatID] = chat.InviteLink
-	return chat.InviteLink, nil
+	chatInviteLinks[chatID] = inviteLinkEntry{link: link, expires: time.Now().Add(inviteLinkTTL)}
+	return link, nil
 }
 
-func fSub(b *gotgbot.Bot, userId int64, arg string) (bool, error) {
-	chats := FSubIds
-	if len(chats) == 0 {
-		log.Print("FSub IDs not set")
+func newInviteLink(b *gotgbot.Bot, chatID int64) (string, error) {
+	botAPILimiter.Wait()
+	if JoinRequestLinks {
+		link, err := b.CreateChatInviteLink(chatID, &gotgbot.CreateChatInviteLinkOpts{
+			Name:               "fsub join request",
+			CreatesJoinRequest: true,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create join request link: %v", err)
+		}
+		return link.InviteLink, nil
+	}
+
+	chat, err := b.GetChat(chatID, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get chat: %v", err)
+	}
+	if chat.InviteLink != "" {
+		return chat.InviteLink, nil
+	}
+
+	link, err := b.ExportChatInviteLink(chatID, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to export invite link: %v", err)
+	}
+	if link == "" {
+		return "", fmt.Errorf("chat has no invite link")
+	}
+	return link, nil
+}
+
+// reportInviteLinkFailure tells the logger chat that users can't be sent a
+// link to chatID, at most once per inviteLinkReportInterval.
+func reportInviteLinkFailure(b *gotgbot.Bot, chatID int64, err error) {
+	log.Printf("Invite link not available for chat %d: %v", chatID, err)
+
+	inviteLinkReportMutex.Lock()
+	last := inviteLinkReported[chatID]
+	if time.Since(last) < inviteLinkReportInterval {
+		inviteLinkReportMutex.Unlock()
+		return
+	}
+	inviteLinkReported[chatID] = time.Now()
+	inviteLinkReportMutex.Unlock()
+
+	_, _ = b.SendMessage(LoggerID, fmt.Sprintf(
+		"⚠️ <b>Invite link unavailable</b>\n\n"+
+			"Users can't be sent a link to join <code>%d</code>.\n"+
+			"Make sure the bot is an admin with the invite users right, then run <code>/fsub refresh %d</code>.\n\n"+
+			"<code>%s</code>",
+		chatID, chatID, html.EscapeString(CustomError(err).Error())), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+}
+
+// invalidateInviteLinks drops the cached invite link of chatID, or of every
+// chat when chatID is zero.
+func invalidateInviteLinks(chatID int64) {
+	chatCacheMutex.Lock()
+	defer chatCacheMutex.Unlock()
+
+	if chatID == 0 {
+		chatInviteLinks = make(map[int64]inviteLinkEntry)
+		return
+	}
+	delete(chatInviteLinks, chatID)
+}
+
+func cachedMember(chatID, userID int64) bool {
+	memberCacheMutex.Lock()
+	defer memberCacheMutex.Unlock()
+
+	key := memberKey{chatID: chatID, userID: userID}
+	expiry, found := memberCache[key]
+	if !found {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(memberCache, key)
+		return false
+	}
+	return true
+}
+
+// isChannelMember reports whether userID has joined chatID, consulting the
+// membership cache first. A pending join request counts when
+// AcceptPendingRequests is set.
+func (a *app) isChannelMember(b *gotgbot.Bot, chatID, userID int64) (bool, error) {
+	if cachedMember(chatID, userID) {
 		return true, nil
 	}
 
-	for _, chatID := range chats {
-		userMember, err := b.GetChatMember(chatID, userId, nil)
-		if err != nil {
-			return false, fmt.Errorf("error getting chat member: %s", err)
+	botAPILimiter.Wait()
+	userMember, err := b.GetChatMember(chatID, userID, nil)
+	if err != nil {
+		return false, fmt.Errorf("error getting chat member: %s", err)
+	}
+
+	if !memberStatuses[userMember.MergeChatMember().Status] {
+		return a.hasPendingRequest(chatID, userID), nil
+	}
+
+	memberCacheMutex.Lock()
+	memberCache[memberKey{chatID: chatID, userID: userID}] = time.Now().Add(memberCacheTTL)
+	memberCacheMutex.Unlock()
+	return true, nil
+}
+
+// joinLink returns the link a user should join chatID with. Users arriving
+// through a referral or campaign get that referrer's or campaign's own
+// invite link so the join can be attributed; everyone else gets the
+// channel's primary link.
+func (a *app) joinLink(b *gotgbot.Bot, chatID, referrerID int64, campaign string) (string, error) {
+	if referrerID != 0 || campaign != "" {
+		link, err := a.referralInviteLink(b, chatID, referrerID, campaign)
+		if err == nil {
+			return link, nil
 		}
+		log.Printf("Falling back to the primary invite link: %v", err)
+	}
 
-		mem := userMember.MergeChatMember()
-		if !memberStatuses[mem.Status] {
-			inviteLink, err := fetchInviteLink(b, chatID)
-			if err != nil || inviteLink == "" {
-				return false, fmt.Errorf("invite link not available")
-			}
+	return fetchInviteLink(b, chatID)
+}
 
-			btn := retryMarkup(b, arg, inviteLink)
-			_, err = b.SendMessage(userId, "❌ You must be a member of the channel to use this bot.\nPlease join the channel and try again.", &gotgbot.SendMessageOpts{
-				ReplyMarkup: btn,
-			})
+// channelCheck is the outcome of checking one force-subscribe channel.
+type channelCheck struct {
+	satisfied bool
+	link      string
+	err       error
+}
+
+// checkChannel checks userID's membership of chatID and, when unsatisfied,
+// fetches the link to join it with.
+func (a *app) checkChannel(b *gotgbot.Bot, chatID, userID, referrerID int64, campaign string) channelCheck {
+	isMember, err := a.isChannelMember(b, chatID, userID)
+	if err != nil {
+		return channelCheck{err: err}
+	}
+	if isMember {
+		return channelCheck{satisfied: true}
+	}
+
+	inviteLink, err := a.joinLink(b, chatID, referrerID, campaign)
+	if err != nil || inviteLink == "" {
+		return channelCheck{err: fmt.Errorf("invite link not available for chat %d", chatID)}
+	}
+	return channelCheck{link: inviteLink}
+}
+
+// fSub checks that the user is a member of every force-subscribe channel.
+// If not, it sends a single prompt listing the channels still to join.
+func (a *app) fSub(b *gotgbot.Bot, userId int64, arg string) (bool, error) {
+	chats := fsubChannels()
+	if len(chats) == 0 {
+		return true, nil
+	}
 
-			if err != nil {
-				log.Printf("Error sending message: %s", err)
+	// Resolve the start argument the way register does, so the join links
+	// match the referral the user will be registered with.
+	arg = strings.TrimSpace(arg)
+	var referrerID int64
+	var campaign string
+	if code, ok := campaignCode(arg); ok {
+		if c, err := a.store.GetCampaign(code); err == nil && c.active(time.Now()) {
+			campaign = c.Code
+			if c.PartnerID != userId {
+				referrerID = c.PartnerID
+			}
+		}
+	} else if arg != "" {
+		if id, err := a.resolveReferralCode(arg); err == nil && id != userId {
+			if _, err := a.store.GetUser(id); err == nil {
+				referrerID = id
 			}
+		}
+	}
 
-			return false, nil
+	// Check every channel at once; results keep the channel order.
+	results := make([]channelCheck, len(chats))
+	var wg sync.WaitGroup
+	for i, chatID := range chats {
+		wg.Add(1)
+		go func(i int, chatID int64) {
+			defer wg.Done()
+			results[i] = a.checkChannel(b, chatID, userId, referrerID, campaign)
+		}(i, chatID)
+	}
+	wg.Wait()
+
+	var links []string
+	for _, res := range results {
+		if res.err != nil {
+			return false, res.err
+		}
+		if !res.satisfied {
+			links = append(links, res.link)
 		}
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	if len(links) == 0 {
+		return true, nil
 	}
 
-	return true, nil
+	text := "❌ You must be a member of the channel to use this bot.\nPlease join the channel and try again."
+	if len(links) > 1 {
+		text = "❌ You must be a member of these channels to use this bot.\nPlease join them all and try again."
+	}
+
+	_, err := b.SendMessage(userId, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: retryMarkup(b, arg, links),
+	})
+	if err != nil {
+		log.Printf("Error sending message: %s", err)
+	}
+
+	return false, nil
+}
+
+// fsubGuard runs before every other handler and stops the update unless the
+// user has joined the force-subscribe channels. Admins and the commands in
+// fsubExemptCommands always pass, as does anything outside private chats.
+func (a *app) fsubGuard(b *gotgbot.Bot, ctx *ext.Context) error {
+	user := ctx.EffectiveUser
+	chat := ctx.EffectiveChat
+	if user == nil || chat == nil || chat.Type != "private" || isFinanceAdmin(user.Id) {
+		return nil
+	}
+
+	var startArgs string
+	if msg := ctx.Message; msg != nil && strings.HasPrefix(msg.Text, "/") {
+		args := strings.Fields(msg.Text)
+		command := strings.ToLower(strings.SplitN(args[0][1:], "@", 2)[0])
+		if fsubExemptCommands[command] {
+			return nil
+		}
+		if command == "start" && len(args) > 1 {
+			startArgs = args[1]
+		}
+	}
+
+	isMember, err := a.fSub(b, user.Id, startArgs)
+	if err != nil {
+		log.Printf("fsub check failed for %d: %v", user.Id, err)
+		if ctx.CallbackQuery != nil {
+			_, _ = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      "❌ An error occurred. Please try again later.",
+				ShowAlert: true,
+			})
+		} else {
+			_, _ = ctx.EffectiveMessage.Reply(b, "❌ An error occurred. Please try again later.", nil)
+		}
+		return ext.EndGroups
+	}
+
+	if !isMember {
+		if ctx.CallbackQuery != nil {
+			_, _ = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+				Text:      "❌ Please join the channel first.",
+				ShowAlert: true,
+			})
+		}
+		return ext.EndGroups
+	}
+
+	return nil
+}
+
+func (a *app) fsubCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if user.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	usage := "❌ Invalid arguments.\n\nUsage:\n<code>/fsub add &lt;chat_id|@username&gt;</code>\n<code>/fsub remove &lt;chat_id&gt;</code>\n<code>/fsub list</code>\n<code>/fsub refresh [chat_id]</code>"
+	args := ctx.Args()[1:]
+	if len(args) == 0 {
+		_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list":
+		channels, err := a.store.FSubChannels()
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Failed to load channels.\n\n"+CustomError(err).Error(), nil)
+			return err
+		}
+
+		text := "📢 <b>Force-subscribe channels</b>\n\n"
+		if len(FSubIds) == 0 && len(channels) == 0 {
+			text += "None. Force-subscribe is disabled."
+		}
+		for _, id := range FSubIds {
+			text += fmt.Sprintf("• <code>%d</code> (FSUB_IDS)\n", id)
+		}
+		for _, ch := range channels {
+			text += fmt.Sprintf("• <code>%d</code> %s\n", ch.ID, html.EscapeString(ch.Title))
+		}
+
+		_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+
+	case "add":
+		if len(args) < 2 {
+			_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+
+		chat, err := resolveChat(b, args[1])
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Chat not found. Make sure the bot has been added to it.\n\n"+CustomError(err).Error(), nil)
+			return nil
+		}
+
+		member, err := b.GetChatMember(chat.Id, b.Id, nil)
+		if err != nil || member.GetStatus() != "administrator" {
+			_, _ = msg.Reply(b, "❌ The bot must be an admin in that chat to check memberships and invite users.", nil)
+			return nil
+		}
+
+		err = a.store.AddFSubChannel(FSubChannel{ID: chat.Id, Title: chat.Title, AddedBy: user.Id, AddedAt: time.Now()})
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Failed to add channel.\n\n"+CustomError(err).Error(), nil)
+			return nil
+		}
+
+		if err := a.reloadFSubChannels(); err != nil {
+			log.Printf("Failed to reload fsub channels: %v", err)
+		}
+
+		_, _ = msg.Reply(b, fmt.Sprintf("✅ <b>%s</b> (<code>%d</code>) added to force-subscribe.", html.EscapeString(chat.Title), chat.Id), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+
+	case "refresh":
+		var chatID int64
+		if len(args) > 1 {
+			chatID = stringToInt64(args[1])
+		}
+
+		invalidateInviteLinks(chatID)
+		if chatID == 0 {
+			_, _ = msg.Reply(b, "✅ All cached invite links cleared.", nil)
+		} else {
+			_, _ = msg.Reply(b, fmt.Sprintf("✅ Cached invite link for <code>%d</code> cleared.", chatID), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		}
+		return nil
+
+	case "remove":
+		if len(args) < 2 {
+			_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+
+		chatID := stringToInt64(args[1])
+		if containsInt64(FSubIds, chatID) {
+			_, _ = msg.Reply(b, "❌ That channel comes from FSUB_IDS. Remove it from the environment instead.", nil)
+			return nil
+		}
+
+		if err := a.store.RemoveFSubChannel(chatID); err != nil {
+			_, _ = msg.Reply(b, "❌ Failed to remove channel.\n\n"+CustomError(err).Error(), nil)
+			return nil
+		}
+
+		if err := a.reloadFSubChannels(); err != nil {
+			log.Printf("Failed to reload fsub channels: %v", err)
+		}
+
+		_, _ = msg.Reply(b, fmt.Sprintf("✅ <code>%d</code> removed from force-subscribe.", chatID), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+
+	default:
+		_, _ = msg.Reply(b, usage, &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
 }
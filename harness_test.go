@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+const (
+	testToken    = "123456:test-token"
+	testBotID    = 123456
+	testOwnerID  = 1
+	testLoggerID = 2
+)
+
+// apiCall is one request the bot made to the fake Bot API.
+type apiCall struct {
+	Method string
+	Params map[string]string
+}
+
+// fakeBotAPI is a local stand-in for the Telegram Bot API. It records every
+// call and answers with canned results good enough for the handlers.
+type fakeBotAPI struct {
+	srv *httptest.Server
+	t   *testing.T
+
+	mu            sync.Mutex
+	calls         []apiCall
+	members       map[int64]map[int64]string
+	inviteLinks   map[int64]string
+	photos        map[int64]int
+	failing       map[string]bool
+	barriers      map[string]*barrier
+	inFlight      map[string]int
+	peak          map[string]int
+	nextMessageID int64
+}
+
+// barrier holds calls until n of them are in flight at once.
+type barrier struct {
+	n       int
+	release chan struct{}
+}
+
+func newFakeBotAPI(t *testing.T) *fakeBotAPI {
+	f := &fakeBotAPI{
+		t:           t,
+		members:     make(map[int64]map[int64]string),
+		inviteLinks: make(map[int64]string),
+		photos:      make(map[int64]int),
+		failing:     make(map[string]bool),
+		barriers:    make(map[string]*barrier),
+		inFlight:    make(map[string]int),
+		peak:        make(map[string]int),
+	}
+	f.srv = httptest.NewServer(f)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// setMember scripts the status getChatMember reports for userID in chatID.
+func (f *fakeBotAPI) setMember(chatID, userID int64, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.members[chatID] == nil {
+		f.members[chatID] = make(map[int64]string)
+	}
+	f.members[chatID][userID] = status
+}
+
+// setInviteLink scripts the primary invite link getChat reports for chatID.
+func (f *fakeBotAPI) setInviteLink(chatID int64, link string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inviteLinks[chatID] = link
+}
+
+// setPhotos scripts how many profile photos userID has. Users have one by
+// default.
+func (f *fakeBotAPI) setPhotos(userID int64, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.photos[userID] = count
+}
+
+// fail makes every call to method return a Bot API error.
+func (f *fakeBotAPI) fail(method string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[method] = true
+}
+
+// failIn makes calls to method for chatID return a Bot API error.
+func (f *fakeBotAPI) failIn(method string, chatID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[method+":"+strconv.FormatInt(chatID, 10)] = true
+}
+
+// hold makes calls to method wait until n of them are in flight at once, so
+// tests can tell concurrent calls from sequential ones. Calls give up waiting
+// after a second.
+func (f *fakeBotAPI) hold(method string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.barriers[method] = &barrier{n: n, release: make(chan struct{})}
+}
+
+// peakInFlight returns the most calls to method that were in flight at once.
+func (f *fakeBotAPI) peakInFlight(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peak[method]
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := path.Base(r.URL.Path)
+
+	params := map[string]string{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		_ = r.ParseMultipartForm(1 << 20)
+		for k, v := range r.MultipartForm.Value {
+			params[k] = v[0]
+		}
+	} else {
+		_ = json.NewDecoder(r.Body).Decode(&params)
+	}
+
+	f.mu.Lock()
+	f.inFlight[method]++
+	if f.inFlight[method] > f.peak[method] {
+		f.peak[method] = f.inFlight[method]
+	}
+	hold := f.barriers[method]
+	if hold != nil && f.inFlight[method] == hold.n {
+		close(hold.release)
+	}
+	f.mu.Unlock()
+	if hold != nil {
+		select {
+		case <-hold.release:
+		case <-time.After(time.Second):
+		}
+	}
+
+	f.mu.Lock()
+	f.inFlight[method]--
+	f.calls = append(f.calls, apiCall{Method: method, Params: params})
+	failing := f.failing[method] || f.failing[method+":"+params["chat_id"]]
+	if err := checkCallbackData(params["reply_markup"]); err != nil {
+		f.t.Errorf("%s: %v", method, err)
+		failing = true
+	}
+	result := f.result(method, params)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if failing {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": "Bad Request: not enough rights"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// checkCallbackData enforces Telegram's 64 byte limit on inline button
+// callback data, which the real API rejects with BUTTON_DATA_INVALID.
+func checkCallbackData(replyMarkup string) error {
+	if replyMarkup == "" {
+		return nil
+	}
+
+	var markup gotgbot.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(replyMarkup), &markup); err != nil {
+		return nil
+	}
+	for _, row := range markup.InlineKeyboard {
+		for _, b := range row {
+			if len(b.CallbackData) > 64 {
+				return fmt.Errorf("callback data of %q is %d bytes, over the 64 byte limit", b.Text, len(b.CallbackData))
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeBotAPI) result(method string, params map[string]string) interface{} {
+	switch method {
+	case "getMe":
+		return map[string]interface{}{"id": testBotID, "is_bot": true, "first_name": "Earnify", "username": "earnify_bot"}
+	case "sendMessage", "editMessageText":
+		f.nextMessageID++
+		chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+		return map[string]interface{}{
+			"message_id": f.nextMessageID,
+			"date":       time.Now().Unix(),
+			"chat":       map[string]interface{}{"id": chatID, "type": "private"},
+			"text":       params["text"],
+		}
+	case "copyMessage":
+		f.nextMessageID++
+		return map[string]interface{}{"message_id": f.nextMessageID}
+	case "getChatMember":
+		chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+		userID, _ := strconv.ParseInt(params["user_id"], 10, 64)
+		status := f.members[chatID][userID]
+		if status == "" {
+			status = "left"
+		}
+		return map[string]interface{}{
+			"status": status,
+			"user":   map[string]interface{}{"id": userID, "is_bot": false, "first_name": "User"},
+		}
+	case "getChat":
+		chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+		link, ok := f.inviteLinks[chatID]
+		if !ok {
+			link = fmt.Sprintf("https://t.me/+invite%d", -chatID)
+		}
+		return map[string]interface{}{
+			"id":                 chatID,
+			"type":               "supergroup",
+			"title":              "Channel",
+			"invite_link":        link,
+			"accent_color_id":    0,
+			"max_reaction_count": 0,
+		}
+	case "getUserProfilePhotos":
+		userID, _ := strconv.ParseInt(params["user_id"], 10, 64)
+		count, ok := f.photos[userID]
+		if !ok {
+			count = 1
+		}
+		photos := make([][]interface{}, count)
+		for i := range photos {
+			photos[i] = []interface{}{}
+		}
+		return map[string]interface{}{"total_count": count, "photos": photos}
+	case "exportChatInviteLink":
+		chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+		return fmt.Sprintf("https://t.me/+exported%d", -chatID)
+	case "createChatInviteLink":
+		f.nextMessageID++
+		return map[string]interface{}{
+			"invite_link":          fmt.Sprintf("https://t.me/+link%d", f.nextMessageID),
+			"creator":              map[string]interface{}{"id": testBotID, "is_bot": true, "first_name": "Earnify"},
+			"creates_join_request": params["creates_join_request"] == "true",
+			"is_primary":           false,
+			"is_revoked":           false,
+			"name":                 params["name"],
+		}
+	default:
+		return true
+	}
+}
+
+// Calls returns the recorded calls to method, or every call if method is empty.
+func (f *fakeBotAPI) Calls(method string) []apiCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls []apiCall
+	for _, c := range f.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets every recorded call.
+func (f *fakeBotAPI) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// harness feeds scripted updates through the real dispatcher, backed by an
+// in-memory store and the fake Bot API.
+type harness struct {
+	t          *testing.T
+	api        *fakeBotAPI
+	bot        *gotgbot.Bot
+	store      *memoryStore
+	app        *app
+	dispatcher *ext.Dispatcher
+
+	mu           sync.Mutex
+	nextUpdateID int64
+}
+
+func newHarness(t *testing.T, users ...User) *harness {
+	t.Helper()
+
+	prevOwner, prevLogger, prevFSub, prevAdmins := OwnerID, LoggerID, FSubIds, FinanceAdmins
+	OwnerID, LoggerID, FSubIds, FinanceAdmins = testOwnerID, testLoggerID, nil, nil
+	prevLinks, prevPending, prevApprove := JoinRequestLinks, AcceptPendingRequests, AutoApproveRequests
+	JoinRequestLinks, AcceptPendingRequests, AutoApproveRequests = false, false, false
+	t.Cleanup(func() {
+		OwnerID, LoggerID, FSubIds, FinanceAdmins = prevOwner, prevLogger, prevFSub, prevAdmins
+		JoinRequestLinks, AcceptPendingRequests, AutoApproveRequests = prevLinks, prevPending, prevApprove
+	})
+
+	memberCacheMutex.Lock()
+	memberCache = make(map[memberKey]time.Time)
+	memberCacheMutex.Unlock()
+	invalidateInviteLinks(0)
+	activityWrittenMutex.Lock()
+	activityWritten = make(map[int64]time.Time)
+	activityWrittenMutex.Unlock()
+	pendingCaptchasMu.Lock()
+	pendingCaptchas = make(map[int64]captchaChallenge)
+	pendingCaptchasMu.Unlock()
+	resetLeaderboardCache()
+
+	api := newFakeBotAPI(t)
+	bot, err := gotgbot.NewBot(testToken, &gotgbot.BotOpts{
+		BotClient: &gotgbot.BaseBotClient{
+			Client: http.Client{},
+			DefaultRequestOpts: &gotgbot.RequestOpts{
+				Timeout: gotgbot.DefaultTimeout,
+				APIURL:  api.srv.URL,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewBot: %v", err)
+	}
+	api.Reset()
+
+	mem := newMemoryStore(users...)
+	a := newApp(mem)
+	if err := a.reloadFSubChannels(); err != nil {
+		t.Fatalf("reloadFSubChannels: %v", err)
+	}
+	if err := a.loadSettings(); err != nil {
+		t.Fatalf("loadSettings: %v", err)
+	}
+
+	return &harness{
+		t:          t,
+		api:        api,
+		bot:        bot,
+		store:      mem,
+		app:        a,
+		dispatcher: newDispatcher(a),
+	}
+}
+
+func (h *harness) process(update *gotgbot.Update) {
+	h.t.Helper()
+
+	h.mu.Lock()
+	h.nextUpdateID++
+	update.UpdateId = h.nextUpdateID
+	h.mu.Unlock()
+
+	if err := h.dispatcher.ProcessUpdate(h.bot, update, nil); err != nil {
+		h.t.Fatalf("ProcessUpdate: %v", err)
+	}
+}
+
+// sendText delivers a text message from the user in their private chat.
+func (h *harness) sendText(from gotgbot.User, text string) {
+	h.sendTextIn(from, gotgbot.Chat{Id: from.Id, Type: "private"}, text, nil)
+}
+
+func (h *harness) sendTextIn(from gotgbot.User, chat gotgbot.Chat, text string, replyTo *gotgbot.Message) {
+	h.t.Helper()
+
+	msg := &gotgbot.Message{
+		MessageId:      time.Now().UnixNano() % 1e9,
+		Date:           time.Now().Unix(),
+		From:           &from,
+		Chat:           chat,
+		Text:           text,
+		ReplyToMessage: replyTo,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		msg.Entities = []gotgbot.MessageEntity{{Type: "bot_command", Offset: 0, Length: int64(length)}}
+	}
+
+	h.process(&gotgbot.Update{Message: msg})
+}
+
+// press delivers a callback query for a button on a bot message in chat.
+func (h *harness) press(from gotgbot.User, chat gotgbot.Chat, data string) {
+	h.t.Helper()
+
+	h.process(&gotgbot.Update{CallbackQuery: &gotgbot.CallbackQuery{
+		Id:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		From: from,
+		Message: gotgbot.Message{
+			MessageId: 1,
+			Date:      time.Now().Unix(),
+			Chat:      chat,
+			From:      &gotgbot.User{Id: testBotID, IsBot: true, FirstName: "Earnify"},
+		},
+		ChatInstance: "test",
+		Data:         data,
+	}})
+}
+
+// memberUpdate delivers a chat_member update moving user from old to new
+// status in chatID.
+func (h *harness) memberUpdate(chatID int64, user gotgbot.User, old, new string) {
+	h.memberUpdateVia(chatID, user, old, new, "")
+}
+
+// memberUpdateVia is memberUpdate for a join through inviteLink.
+func (h *harness) memberUpdateVia(chatID int64, user gotgbot.User, old, new, inviteLink string) {
+	h.t.Helper()
+
+	update := &gotgbot.ChatMemberUpdated{
+		Chat:          gotgbot.Chat{Id: chatID, Type: "channel"},
+		From:          user,
+		Date:          time.Now().Unix(),
+		OldChatMember: chatMemberWithStatus(user, old),
+		NewChatMember: chatMemberWithStatus(user, new),
+	}
+	if inviteLink != "" {
+		update.InviteLink = &gotgbot.ChatInviteLink{InviteLink: inviteLink, Creator: gotgbot.User{Id: testBotID, IsBot: true}}
+	}
+	h.process(&gotgbot.Update{ChatMember: update})
+}
+
+func chatMemberWithStatus(user gotgbot.User, status string) gotgbot.ChatMember {
+	switch status {
+	case "member":
+		return gotgbot.ChatMemberMember{User: user}
+	case "left":
+		return gotgbot.ChatMemberLeft{User: user}
+	default:
+		panic("unsupported chat member status " + status)
+	}
+}
+
+// joinRequest delivers a chat_join_request from user to chatID.
+func (h *harness) joinRequest(chatID int64, user gotgbot.User) {
+	h.process(&gotgbot.Update{ChatJoinRequest: &gotgbot.ChatJoinRequest{
+		Chat:       gotgbot.Chat{Id: chatID, Type: "channel"},
+		From:       user,
+		UserChatId: user.Id,
+		Date:       time.Now().Unix(),
+	}})
+}
+
+// lastText returns the text of the most recent sendMessage to chatID.
+func (h *harness) lastText(chatID int64) string {
+	h.t.Helper()
+
+	calls := h.api.Calls("sendMessage")
+	for i := len(calls) - 1; i >= 0; i-- {
+		if calls[i].Params["chat_id"] == strconv.FormatInt(chatID, 10) {
+			return calls[i].Params["text"]
+		}
+	}
+	return ""
+}
+
+func decodeMarkup(t *testing.T, call apiCall) gotgbot.InlineKeyboardMarkup {
+	t.Helper()
+
+	var markup gotgbot.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(call.Params["reply_markup"]), &markup); err != nil {
+		t.Fatalf("decode reply_markup: %v", err)
+	}
+	return markup
+}
+
+// buttons returns the callback data of every inline button in a recorded call.
+func buttons(t *testing.T, call apiCall) map[string]string {
+	t.Helper()
+
+	data := make(map[string]string)
+	for _, row := range decodeMarkup(t, call).InlineKeyboard {
+		for _, b := range row {
+			data[b.Text] = b.CallbackData
+		}
+	}
+	return data
+}
+
+func testUser(id int64, name string) gotgbot.User {
+	return gotgbot.User{Id: id, FirstName: name, Username: strings.ToLower(name), LanguageCode: "en"}
+}
+
+func privateChat(id int64) gotgbot.Chat {
+	return gotgbot.Chat{Id: id, Type: "private"}
+}
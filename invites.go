@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ReferralInvite is a named channel invite link created for one referrer or
+// campaign, so channel joins can be attributed to whoever shared it.
+// JoinRequest links make users ask to join instead of joining directly.
+type ReferralInvite struct {
+	Link        string    `bson:"_id" json:"_id"`
+	ChatID      int64     `bson:"chat_id" json:"chat_id"`
+	OwnerID     int64     `bson:"owner_id,omitempty" json:"owner_id,omitempty"`
+	Campaign    string    `bson:"campaign,omitempty" json:"campaign,omitempty"`
+	Name        string    `bson:"name" json:"name"`
+	Joins       int       `bson:"joins" json:"joins"`
+	JoinRequest bool      `bson:"join_request" json:"join_request"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+}
+
+// inviteLinkMutex keeps concurrent referees from creating duplicate links
+// for the same referrer.
+var inviteLinkMutex sync.Mutex
+
+// referralInviteLink returns the invite link for chatID owned by ownerID or
+// campaign, creating it with CreateChatInviteLink on first use.
+func (a *app) referralInviteLink(b *gotgbot.Bot, chatID, ownerID int64, campaign string) (string, error) {
+	inviteLinkMutex.Lock()
+	defer inviteLinkMutex.Unlock()
+
+	invite, err := a.store.FindInviteLink(chatID, ownerID, campaign, JoinRequestLinks)
+	if err == nil {
+		return invite.Link, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return "", err
+	}
+
+	name := fmt.Sprintf("ref-%d", ownerID)
+	if campaign != "" {
+		name = "campaign-" + campaign
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	link, err := b.CreateChatInviteLink(chatID, &gotgbot.CreateChatInviteLinkOpts{
+		Name:               name,
+		CreatesJoinRequest: JoinRequestLinks,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create invite link for chat %d: %v", chatID, err)
+	}
+
+	err = a.store.SaveInviteLink(ReferralInvite{
+		Link:        link.InviteLink,
+		ChatID:      chatID,
+		OwnerID:     ownerID,
+		Campaign:    campaign,
+		Name:        name,
+		JoinRequest: JoinRequestLinks,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return link.InviteLink, nil
+}
+
+// attributeJoin credits a channel join to the owner of the invite link used,
+// counting each user at most once per link.
+func (a *app) attributeJoin(event MembershipEvent, previous []MembershipEvent) (*ReferralInvite, error) {
+	if event.InviteLink == "" {
+		return nil, nil
+	}
+
+	invite, err := a.store.InviteLink(event.InviteLink)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range previous {
+		if e.Event == MemberJoined && e.InviteLink == event.InviteLink {
+			return invite, nil
+		}
+	}
+
+	return invite, a.store.IncrementInviteJoins(invite.Link)
+}
+
+// inviteJoins returns how many channel joins the user's invite links produced.
+func (a *app) inviteJoins(ownerID int64) int {
+	invites, err := a.store.InviteLinksByOwner(ownerID)
+	if err != nil {
+		return 0
+	}
+
+	var joins int
+	for _, inv := range invites {
+		joins += inv.Joins
+	}
+	return joins
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// pendingRequestTTL bounds how long a join request counts towards fsub.
+// Telegram doesn't report declined requests, so they simply age out.
+const pendingRequestTTL = 24 * time.Hour
+
+// JoinRequest is a pending request to join a force-subscribe channel.
+type JoinRequest struct {
+	ChatID     int64     `bson:"chat_id" json:"chat_id"`
+	UserID     int64     `bson:"user_id" json:"user_id"`
+	InviteLink string    `bson:"invite_link,omitempty" json:"invite_link,omitempty"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// chatJoinRequest stores join requests to force-subscribe channels and
+// approves them when AutoApproveRequests is set.
+func (a *app) chatJoinRequest(b *gotgbot.Bot, ctx *ext.Context) error {
+	req := ctx.ChatJoinRequest
+	if !containsInt64(fsubChannels(), req.Chat.Id) {
+		return nil
+	}
+
+	if AutoApproveRequests {
+		_, err := b.ApproveChatJoinRequest(req.Chat.Id, req.From.Id, nil)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to approve join request of %d in %d: %v", req.From.Id, req.Chat.Id, err)
+	}
+
+	entry := JoinRequest{
+		ChatID:    req.Chat.Id,
+		UserID:    req.From.Id,
+		CreatedAt: time.Now(),
+	}
+	if req.InviteLink != nil {
+		entry.InviteLink = req.InviteLink.InviteLink
+	}
+
+	if err := a.store.SaveJoinRequest(entry); err != nil {
+		return fmt.Errorf("chatJoinRequest: %v", err)
+	}
+	return nil
+}
+
+// hasPendingRequest reports whether a recent join request from userID to
+// chatID should satisfy force-subscribe.
+func (a *app) hasPendingRequest(chatID, userID int64) bool {
+	if !AcceptPendingRequests {
+		return false
+	}
+
+	req, err := a.store.JoinRequest(chatID, userID)
+	if err != nil {
+		return false
+	}
+	return time.Since(req.CreatedAt) < pendingRequestTTL
+}
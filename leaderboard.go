@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// leaderboardCacheTTL is how long a computed ranking is served before it is
+// rebuilt from the referrals.
+const leaderboardCacheTTL = 5 * time.Minute
+
+// leaderboardSize is how many referrers the leaderboard lists.
+const leaderboardSize = 10
+
+// Leaderboard periods. Periods other than all time start at the beginning
+// of the current UTC day, week (Monday) or month. Referrals count towards
+// the period they were confirmed in, after any hold.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+	PeriodAll   = "all"
+)
+
+var (
+	leaderboardPeriods = []string{PeriodDay, PeriodWeek, PeriodMonth, PeriodAll}
+	leaderboardTitles  = map[string]string{
+		PeriodDay:   "Today",
+		PeriodWeek:  "This Week",
+		PeriodMonth: "This Month",
+		PeriodAll:   "All Time",
+	}
+
+	leaderboardCache      = make(map[string]leaderboard)
+	leaderboardCacheMutex sync.Mutex
+)
+
+// leaderRank is a referrer's number of confirmed referrals in a period.
+type leaderRank struct {
+	UserID    int64 `bson:"_id"`
+	Referrals int   `bson:"referrals"`
+}
+
+type leaderboard struct {
+	ranks   []leaderRank
+	builtAt time.Time
+}
+
+// parsePeriod maps /top arguments to a leaderboard period.
+func parsePeriod(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "day", "daily", "today":
+		return PeriodDay, true
+	case "week", "weekly":
+		return PeriodWeek, true
+	case "month", "monthly":
+		return PeriodMonth, true
+	case "all", "alltime", "all-time":
+		return PeriodAll, true
+	}
+	return "", false
+}
+
+func periodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case PeriodDay:
+		return day
+	case PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case PeriodMonth:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}
+	}
+}
+
+// resetLeaderboardCache drops every cached ranking.
+func resetLeaderboardCache() {
+	leaderboardCacheMutex.Lock()
+	leaderboardCache = make(map[string]leaderboard)
+	leaderboardCacheMutex.Unlock()
+}
+
+// leaderboardRanks returns every visible referrer with a referral confirmed
+// in period, most referrals first.
+func (a *app) leaderboardRanks(period string) ([]leaderRank, error) {
+	leaderboardCacheMutex.Lock()
+	cached, ok := leaderboardCache[period]
+	leaderboardCacheMutex.Unlock()
+	if ok && time.Since(cached.builtAt) < leaderboardCacheTTL {
+		return cached.ranks, nil
+	}
+
+	ranks, err := a.store.ReferrerRanks(periodStart(period, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := a.store.UsersHiddenFromTop()
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[int64]bool, len(hidden))
+	for _, id := range hidden {
+		skip[id] = true
+	}
+
+	visible := make([]leaderRank, 0, len(ranks))
+	for _, r := range ranks {
+		if !skip[r.UserID] {
+			visible = append(visible, r)
+		}
+	}
+
+	leaderboardCacheMutex.Lock()
+	leaderboardCache[period] = leaderboard{ranks: visible, builtAt: time.Now()}
+	leaderboardCacheMutex.Unlock()
+	return visible, nil
+}
+
+// maskUserID hides all but the last digits of a user ID.
+func maskUserID(id int64) string {
+	s := strconv.FormatInt(id, 10)
+	if len(s) <= 4 {
+		return s
+	}
+	return "••••" + s[len(s)-4:]
+}
+
+func (a *app) leaderboardText(user *User, period string) (string, error) {
+	ranks, err := a.leaderboardRanks(period)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🏆 <b>Leaderboard · %s</b>\n\n", leaderboardTitles[period])
+	if period == PeriodAll {
+		sb.WriteString("<i>Counts referrals confirmed since referral tracking began; earlier referrals aren't ranked.</i>\n\n")
+	}
+	if len(ranks) == 0 {
+		sb.WriteString("No confirmed referrals yet.\n")
+	}
+	medals := []string{"🥇", "🥈", "🥉"}
+	for i, r := range ranks {
+		if i == leaderboardSize {
+			break
+		}
+		place := strconv.Itoa(i+1) + "."
+		if i < len(medals) {
+			place = medals[i]
+		}
+		you := ""
+		if r.UserID == user.ID {
+			you = " (you)"
+		}
+		fmt.Fprintf(&sb, "%s <code>%s</code>%s · %d\n", place, maskUserID(r.UserID), you, r.Referrals)
+	}
+
+	sb.WriteString("\n")
+	if user.HideFromTop {
+		sb.WriteString("🙈 You're hidden from the leaderboard. Use /top show to appear.")
+		return sb.String(), nil
+	}
+	for i, r := range ranks {
+		if r.UserID == user.ID {
+			fmt.Fprintf(&sb, "📍 <b>Your Rank:</b> #%d with %d referral(s).", i+1, r.Referrals)
+			return sb.String(), nil
+		}
+	}
+	sb.WriteString("📍 <b>Your Rank:</b> unranked, no confirmed referrals yet.")
+	return sb.String(), nil
+}
+
+func leaderboardMarkup(userID int64, period string) gotgbot.InlineKeyboardMarkup {
+	row := make([]gotgbot.InlineKeyboardButton, len(leaderboardPeriods))
+	for i, p := range leaderboardPeriods {
+		text := leaderboardTitles[p]
+		if p == period {
+			text = "• " + text
+		}
+		row[i] = gotgbot.InlineKeyboardButton{
+			Text:         text,
+			CallbackData: signCallback(fmt.Sprintf("top.%d.%s", userID, p), userCallbackTTL),
+		}
+	}
+	return gotgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+			row,
+			{{Text: " Home", CallbackData: "home"}},
+		},
+	}
+}
+
+// topCmd shows the leaderboard, or hides the caller from it.
+func (a *app) topCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	args := ctx.Args()[1:]
+
+	user, err := a.store.GetUser(ctx.EffectiveUser.Id)
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Please use /start first.", nil)
+		return nil
+	}
+
+	period := PeriodWeek
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "hide", "show":
+			hide := strings.ToLower(args[0]) == "hide"
+			if err := a.store.SetHideFromTop(user.ID, hide); err != nil {
+				_, _ = msg.Reply(b, "❌ Failed to update your leaderboard visibility.\n\n"+CustomError(err).Error(), nil)
+				return err
+			}
+			resetLeaderboardCache()
+
+			text := "👀 You're shown on the leaderboard again."
+			if hide {
+				text = "🙈 You're now hidden from the leaderboard. Use /top show to appear again."
+			}
+			_, _ = msg.Reply(b, text, nil)
+			return nil
+		}
+
+		p, ok := parsePeriod(args[0])
+		if !ok {
+			_, _ = msg.Reply(b, "❌ Usage: <code>/top [daily|weekly|monthly|all]</code> or <code>/top hide|show</code>", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+		period = p
+	}
+
+	text, err := a.leaderboardText(user, period)
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to load the leaderboard.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: leaderboardMarkup(user.ID, period),
+	})
+	return nil
+}
+
+// topCallback shows the leaderboard from the home keyboard and switches
+// between its periods.
+func (a *app) topCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.CallbackQuery
+
+	args, ok := userCallbackArgs(b, ctx)
+	if !ok {
+		return nil
+	}
+	period := PeriodWeek
+	if len(args) > 2 {
+		if p, ok := parsePeriod(args[2]); ok {
+			period = p
+		}
+	}
+
+	user, err := a.store.GetUser(ctx.EffectiveUser.Id)
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ User not found.", ShowAlert: true})
+		return nil
+	}
+
+	text, err := a.leaderboardText(user, period)
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "❌ Failed to load the leaderboard.", ShowAlert: true})
+		return fmt.Errorf("topCallback: %v", err)
+	}
+
+	_, _ = query.Answer(b, nil)
+	_, _, _ = msg.EditText(b, text, &gotgbot.EditMessageTextOpts{
+		ParseMode:   "HTML",
+		ReplyMarkup: leaderboardMarkup(user.ID, period),
+	})
+	return nil
+}
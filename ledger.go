@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ledger entry types.
+const (
+	TxOpening     = "opening"
+	TxReferral    = "referral"
+	TxAdminAdd    = "admin_add"
+	TxAdminRemove = "admin_remove"
+	TxWithdrawal  = "withdrawal"
+	TxRefund      = "refund"
+
+	TxCampaignBonus  = "campaign_bonus"
+	TxMilestoneBonus = "milestone_bonus"
+
+	TxReferralReversal = "referral_reversal"
+	TxReferralFreeze   = "referral_freeze"
+	TxReferralRelease  = "referral_release"
+)
+
+// Transaction is an immutable ledger entry describing a single balance change.
+// Amount is signed: credits are positive and debits are negative. Level is
+// the referral level a TxReferral entry was paid for.
+type Transaction struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID        int64              `bson:"user_id" json:"user_id"`
+	Type          string             `bson:"type" json:"type"`
+	Amount        float64            `bson:"amount" json:"amount"`
+	ActorID       int64              `bson:"actor_id" json:"actor_id"`
+	Reason        string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	Level         int                `bson:"level,omitempty" json:"level,omitempty"`
+	BalanceBefore float64            `bson:"balance_before" json:"balance_before"`
+	BalanceAfter  float64            `bson:"balance_after" json:"balance_after"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func ledgerBalance(txs []Transaction) float64 {
+	var balance float64
+	for _, tx := range txs {
+		balance += tx.Amount
+	}
+	return balance
+}
+
+// creditBalance adds amount to the user's balance and records it in the ledger.
+func (a *app) creditBalance(userID int64, amount float64, txType string, actorID int64, reason string) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount to add must be greater than zero")
+	}
+
+	return a.store.Credit(userID, amount, Transaction{Type: txType, ActorID: actorID, Reason: reason})
+}
+
+// debitBalance takes amount from the user's balance and records it in the
+// ledger. It fails with ErrInsufficientBalance rather than going negative.
+func (a *app) debitBalance(userID int64, amount float64, txType string, actorID int64, reason string) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount to remove must be greater than zero")
+	}
+
+	return a.store.Debit(userID, amount, Transaction{Type: txType, ActorID: actorID, Reason: reason})
+}
+
+// backfillOpeningBalances records an opening entry for every user whose
+// balance predates the ledger, so that rebuilding never loses funds.
+func backfillOpeningBalances(store Store) error {
+	users, err := store.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Balance == 0 {
+			continue
+		}
+
+		txs, err := store.Transactions(u.ID)
+		if err != nil {
+			return err
+		}
+		if len(txs) > 0 {
+			continue
+		}
+
+		_, err = store.RecordTransaction(Transaction{
+			UserID:        u.ID,
+			Type:          TxOpening,
+			Amount:        u.Balance,
+			Reason:        "balance before ledger",
+			BalanceBefore: 0,
+			BalanceAfter:  u.Balance,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
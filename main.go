@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
@@ -15,6 +18,9 @@ import (
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/conversation"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/callbackquery"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/chatjoinrequest"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/chatmember"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/message"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -22,8 +28,10 @@ import (
 )
 
 const (
-	WITHDRAWAL = "Withdrawal"
-	SetAcc     = "SetAccount"
+	WITHDRAWAL   = "Withdrawal"
+	SetAcc       = "SetAccount"
+	RejectReason = "RejectReason"
+	CAPTCHA      = "Captcha"
 )
 
 var (
@@ -34,10 +42,34 @@ var (
 	OwnerID        int64
 	LoggerID       int64
 	FSubIds        []int64
-	ctx            = context.TODO()
-	allowedUpdates = []string{"message", "callback_query"}
+	FinanceAdmins  []int64
+	LeavePolicy    = LeavePolicyOff
+	LeaveWindow    = 7 * 24 * time.Hour
+	allowedUpdates = []string{"message", "callback_query", "chat_member", "chat_join_request"}
+
+	// Join-request mode for force-subscribe channels.
+	JoinRequestLinks      bool
+	AcceptPendingRequests bool
+	AutoApproveRequests   bool
 )
 
+// app holds the dependencies shared by the handlers.
+type app struct {
+	store Store
+
+	// pendingRejections holds the withdrawal each admin is currently writing a
+	// rejection reason for.
+	pendingRejections   map[int64]pendingRejection
+	pendingRejectionsMu sync.Mutex
+}
+
+func newApp(store Store) *app {
+	return &app{
+		store:             store,
+		pendingRejections: make(map[int64]pendingRejection),
+	}
+}
+
 func main() {
 	var err error
 	token := os.Getenv("TOKEN")
@@ -55,12 +87,53 @@ func main() {
 		log.Fatal("LOGGER_ID is not set")
 	}
 
-	fsubids, err := strconv.ParseInt(os.Getenv("FSUB_IDS"), 10, 64)
+	// Force-subscribe is optional; an empty FSUB_IDS disables it.
+	FSubIds, err = parseInt64List(os.Getenv("FSUB_IDS"))
+	if err != nil {
+		log.Fatalf("FSUB_IDS is invalid: %v", err)
+	}
+
+	JoinRequestLinks, err = parseBool(os.Getenv("FSUB_JOIN_REQUESTS"))
+	if err != nil {
+		log.Fatalf("FSUB_JOIN_REQUESTS is invalid: %v", err)
+	}
+
+	AcceptPendingRequests, err = parseBool(os.Getenv("FSUB_ACCEPT_PENDING"))
 	if err != nil {
-		log.Fatal("FSUB_IDS is not set")
+		log.Fatalf("FSUB_ACCEPT_PENDING is invalid: %v", err)
+	}
+
+	AutoApproveRequests, err = parseBool(os.Getenv("FSUB_AUTO_APPROVE"))
+	if err != nil {
+		log.Fatalf("FSUB_AUTO_APPROVE is invalid: %v", err)
+	}
+
+	FinanceAdmins, err = parseInt64List(os.Getenv("FINANCE_ADMINS"))
+	if err != nil {
+		log.Fatalf("FINANCE_ADMINS is invalid: %v", err)
+	}
+
+	// REFERRAL_TIERS only seeds the defaults; /settings takes precedence.
+	if tiers := os.Getenv("REFERRAL_TIERS"); tiers != "" {
+		defaultSettings.ReferralTiers, err = parseReferralTiers(tiers)
+		if err != nil {
+			log.Fatalf("REFERRAL_TIERS is invalid: %v", err)
+		}
+	}
+
+	LeavePolicy, err = parseLeavePolicy(os.Getenv("LEAVE_POLICY"))
+	if err != nil {
+		log.Fatalf("LEAVE_POLICY is invalid: %v", err)
+	}
+
+	if days := os.Getenv("LEAVE_WINDOW_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			log.Fatal("LEAVE_WINDOW_DAYS must be a positive number of days")
+		}
+		LeaveWindow = time.Duration(n) * 24 * time.Hour
 	}
 
-	FSubIds = append(FSubIds, fsubids)
 	MongoDBURI = os.Getenv("MONGO_URI")
 
 	secretToken = os.Getenv("SECRET_TOKEN")
@@ -68,9 +141,16 @@ func main() {
 		secretToken = "OopsNoSECRET_TOKENFoundTimeToCallSherlock"
 	}
 
+	callbackSecret := os.Getenv("CALLBACK_SECRET")
+	if callbackSecret == "" {
+		callbackSecret = token
+	}
+	setCallbackSecret(callbackSecret)
+
 	WebhookURL = os.Getenv("WEBHOOK_URL")
 	Port = os.Getenv("PORT")
 
+	ctx := context.TODO()
 	clientOptions := options.Client().ApplyURI(MongoDBURI)
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -83,7 +163,14 @@ func main() {
 
 	fmt.Println("Connected to MongoDB")
 	db := client.Database("tgreferearn")
-	userColl = db.Collection("users")
+	store, err := newMongoStore(ctx, client, db)
+	if err != nil {
+		log.Fatalf("Failed to set up MongoDB: %v", err)
+	}
+
+	if err := backfillOpeningBalances(store); err != nil {
+		log.Fatalf("Failed to backfill ledger: %v", err)
+	}
 
 	bot, err := gotgbot.NewBot(token, &gotgbot.BotOpts{
 		BotClient: &gotgbot.BaseBotClient{
@@ -99,51 +186,17 @@ func main() {
 		log.Fatal(err)
 	}
 
-	dispatcher := ext.NewDispatcher(&ext.DispatcherOpts{
-		Error: func(b *gotgbot.Bot, ctx *ext.Context, err error) ext.DispatcherAction {
-			log.Println("an error occurred while handling update:", err.Error())
-			return ext.DispatcherActionNoop
-		},
-		MaxRoutines: ext.DefaultMaxRoutines,
-	})
-
-	dispatcher.AddHandler(handlers.NewCommand("start", start))
-	dispatcher.AddHandler(handlers.NewCommand("help", help))
-	dispatcher.AddHandler(handlers.NewCommand("info", info))
-	dispatcher.AddHandler(handlers.NewCommand("add", addBalance))
-	dispatcher.AddHandler(handlers.NewCommand("remove", removeBalanceCmd))
-	dispatcher.AddHandler(handlers.NewCommand("accno", updateAccNo))
-	dispatcher.AddHandler(handlers.NewCommand("stats", stats))
-	dispatcher.AddHandler(handlers.NewCommand("broadcast", broadcast))
-
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("info"), infoCallback))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("wallet"), walletCallback))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("confirm_withdrawal"), confirmWithdrawal))
-	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("home"), home))
+	a := newApp(store)
+	if err := a.reloadFSubChannels(); err != nil {
+		log.Fatalf("Failed to load fsub channels: %v", err)
+	}
 
-	dispatcher.AddHandler(handlers.NewConversation(
-		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("withdraw"), withdrawal)},
-		map[string][]ext.Handler{
-			WITHDRAWAL: {handlers.NewMessage(onlyFloat64, withdrawalAsk)},
-		},
-		&handlers.ConversationOpts{
-			Exits:        []ext.Handler{handlers.NewCommand("cancel", cancel)},
-			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
-			AllowReEntry: true,
-		},
-	))
+	if err := a.loadSettings(); err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
 
-	dispatcher.AddHandler(handlers.NewConversation(
-		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("setAccNo"), setAccNo)},
-		map[string][]ext.Handler{
-			SetAcc: {handlers.NewMessage(onlyInt64, setAccAsk)},
-		},
-		&handlers.ConversationOpts{
-			Exits:        []ext.Handler{handlers.NewCommand("cancel", cancel)},
-			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
-			AllowReEntry: true,
-		},
-	))
+	dispatcher := newDispatcher(a)
+	go a.runReferralQualifier(bot)
 
 	updater := ext.NewUpdater(dispatcher, nil)
 
@@ -188,62 +241,106 @@ func main() {
 	updater.Idle()
 }
 
-func start(b *gotgbot.Bot, ctx *ext.Context) error {
-	msg := ctx.EffectiveMessage
-	user := ctx.EffectiveUser
-	args := ctx.Args()[1:]
+// newDispatcher builds the dispatcher with every handler the bot serves.
+func newDispatcher(a *app) *ext.Dispatcher {
+	dispatcher := ext.NewDispatcher(&ext.DispatcherOpts{
+		Error: func(b *gotgbot.Bot, ctx *ext.Context, err error) ext.DispatcherAction {
+			log.Println("an error occurred while handling update:", err.Error())
+			return ext.DispatcherActionNoop
+		},
+		MaxRoutines: ext.DefaultMaxRoutines,
+	})
 
-	var userArgs string
-	if len(args) > 0 {
-		userArgs = args[0]
-	} else {
-		userArgs = ""
-	}
+	// Activity tracking sees every update; force-subscribe runs ahead of
+	// every other handler group.
+	dispatcher.AddHandlerToGroup(handlers.NewMessage(message.All, a.trackActivity), -2)
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(callbackquery.All, a.trackActivity), -2)
+	dispatcher.AddHandlerToGroup(handlers.NewMessage(message.All, a.fsubGuard), -1)
+	dispatcher.AddHandlerToGroup(handlers.NewCallback(callbackquery.All, a.fsubGuard), -1)
+
+	dispatcher.AddHandler(handlers.NewChatMember(chatmember.All, a.chatMemberUpdate))
+	dispatcher.AddHandler(handlers.NewChatJoinRequest(chatjoinrequest.All, a.chatJoinRequest))
+	dispatcher.AddHandler(handlers.NewCommand("help", a.help))
+	dispatcher.AddHandler(handlers.NewCommand("info", a.info))
+	dispatcher.AddHandler(handlers.NewCommand("add", a.addBalance))
+	dispatcher.AddHandler(handlers.NewCommand("remove", a.removeBalanceCmd))
+	dispatcher.AddHandler(handlers.NewCommand("accno", a.updateAccNo))
+	dispatcher.AddHandler(handlers.NewCommand("code", a.codeCmd))
+	dispatcher.AddHandler(handlers.NewCommand("campaign", a.campaignCmd))
+	dispatcher.AddHandler(handlers.NewCommand("top", a.topCmd))
+	dispatcher.AddHandler(handlers.NewCommand("stats", a.stats))
+	dispatcher.AddHandler(handlers.NewCommand("broadcast", a.broadcast))
+	dispatcher.AddHandler(handlers.NewCommand("rebuild", a.rebuildBalanceCmd))
+	dispatcher.AddHandler(handlers.NewCommand("fsub", a.fsubCmd))
+	dispatcher.AddHandler(handlers.NewCommand("settings", a.settingsCmd))
+	dispatcher.AddHandler(handlers.NewCommand("review", a.reviewCmd))
+
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("info"), a.infoCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("wallet"), a.walletCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("confirm_withdrawal"), a.confirmWithdrawal))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("paid_withdrawal"), a.paidWithdrawal))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("cancel_withdrawal"), a.cancelWithdrawal))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("home"), a.home))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("top"), a.topCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("review_"), a.reviewCallback))
 
-	isMember, err := fSub(b, user.Id, userArgs)
-	if err != nil {
-		_, _ = msg.Reply(b, "❌ An error occurred. Please try again later.", nil)
-		return fmt.Errorf("start: %v", err)
-	}
+	dispatcher.AddHandler(handlers.NewConversation(
+		[]ext.Handler{handlers.NewCommand("start", a.start)},
+		map[string][]ext.Handler{
+			CAPTCHA: {handlers.NewCallback(callbackquery.Prefix("captcha"), a.captchaAnswer)},
+		},
+		&handlers.ConversationOpts{
+			Exits:        []ext.Handler{handlers.NewCommand("cancel", a.cancel)},
+			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			AllowReEntry: true,
+		},
+	))
 
-	if !isMember {
-		return ext.EndGroups
-	}
+	dispatcher.AddHandler(handlers.NewConversation(
+		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("withdraw"), a.withdrawal)},
+		map[string][]ext.Handler{
+			WITHDRAWAL: {handlers.NewMessage(onlyFloat64, a.withdrawalAsk)},
+		},
+		&handlers.ConversationOpts{
+			Exits:        []ext.Handler{handlers.NewCommand("cancel", a.cancel)},
+			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			AllowReEntry: true,
+		},
+	))
 
-	referUrl := fmt.Sprintf("https://t.me/%s?start=%d", b.User.Username, user.Id)
+	dispatcher.AddHandler(handlers.NewConversation(
+		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("setAccNo"), a.setAccNo)},
+		map[string][]ext.Handler{
+			SetAcc: {handlers.NewMessage(onlyInt64, a.setAccAsk)},
+		},
+		&handlers.ConversationOpts{
+			Exits:        []ext.Handler{handlers.NewCommand("cancel", a.cancel)},
+			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			AllowReEntry: true,
+		},
+	))
 
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text: "👤 Owner",
-					Url:  fmt.Sprintf("tg://user?id=%d", OwnerID),
-				},
-			},
-			{
-				{
-					Text: "🔗 Refer & Earn",
-					Url:  fmt.Sprintf("https://t.me/share/url?url=%s", referUrl),
-				},
-				{
-					Text:         "ℹ️ Info",
-					CallbackData: fmt.Sprintf("info.%d", user.Id),
-				},
-			},
-			{
-				{
-					Text:         "💼 Wallet",
-					CallbackData: fmt.Sprintf("wallet.%d", user.Id),
-				},
-				{
-					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", user.Id),
-				},
-			},
+	dispatcher.AddHandler(handlers.NewConversation(
+		[]ext.Handler{handlers.NewCallback(callbackquery.Prefix("reject_withdrawal"), a.rejectWithdrawal)},
+		map[string][]ext.Handler{
+			RejectReason: {handlers.NewMessage(message.Text, a.rejectWithdrawalReason)},
 		},
-	}
+		&handlers.ConversationOpts{
+			Exits:        []ext.Handler{handlers.NewCommand("cancel", a.cancel)},
+			StateStorage: conversation.NewInMemoryStorage(conversation.KeyStrategySenderAndChat),
+			AllowReEntry: true,
+		},
+	))
+
+	return dispatcher
+}
+
+func (a *app) start(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	args := ctx.Args()[1:]
 
-	existingUser, err := getUser(user.Id)
+	existingUser, err := a.store.GetUser(user.Id)
 	if err != nil && err.Error() != "mongo: no documents in result" {
 		log.Printf("Failed to fetch user: %v", err)
 		_, _ = msg.Reply(b, "❌ An error occurred. Please try again later.\n/start", nil)
@@ -253,13 +350,13 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 	if existingUser != nil {
 		response := fmt.Sprintf(
 			"👋 <b>Welcome back, %s!</b>\n\n"+
-				"💰 <b>Balance:</b> %.2f\n"+
+				"💰 <b>Balance:</b> %s\n"+
 				"🤝 <b>Referred Users:</b> %d\n\n"+
 				"🚀 Keep earning rewards by referring your friends!",
-			user.FirstName, existingUser.Balance, len(existingUser.ReferredUsers))
+			user.FirstName, formatAmountFiat(existingUser.Balance), len(existingUser.ReferredUsers))
 
 		_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
-			ReplyMarkup: button,
+			ReplyMarkup: a.homeMarkup(b, user.Id),
 			ParseMode:   "HTML",
 			LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
 				IsDisabled: true,
@@ -269,18 +366,60 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
+	if settings().Captcha {
+		if a.captchaLocked(user.Id) {
+			_, _ = msg.Reply(b, "🚫 <b>Too many wrong captcha answers.</b>\n\nPlease try again later.", &gotgbot.SendMessageOpts{
+				ParseMode: "HTML",
+			})
+			return nil
+		}
+		return sendCaptcha(b, user.Id, args)
+	}
+
+	return a.register(b, msg, user, args)
+}
+
+// register adds a new user, crediting their referrer when args holds a
+// referral code, and welcomes them.
+func (a *app) register(b *gotgbot.Bot, msg *gotgbot.Message, user *gotgbot.User, args []string) error {
+	// Campaign links refer new users to the campaign's partner, if it has one.
+	var campaign *Campaign
+	var campaignName string
+	if len(args) > 0 {
+		if code, ok := campaignCode(strings.TrimSpace(args[0])); ok {
+			args = nil
+			c, err := a.store.GetCampaign(code)
+			if err != nil || !c.active(time.Now()) {
+				_, _ = msg.Reply(b, "⌛ This promotion isn't running, so no signup bonus applies.", nil)
+			} else {
+				campaign, campaignName = c, c.Code
+				if c.PartnerID != 0 {
+					args = []string{strconv.FormatInt(c.PartnerID, 10)}
+				}
+			}
+		}
+	}
+
 	var referrerID int64
+	var err error
 	if len(args) > 0 {
 		referralCode := strings.TrimSpace(args[0])
-		referrerID, err = strconv.ParseInt(referralCode, 10, 64)
-		if err != nil || referrerID <= 0 {
+		referrerID, err = a.resolveReferralCode(referralCode)
+		if err != nil {
 			_, _ = msg.Reply(b, "❌ <b>Invalid referral code!</b>\n\nPlease check the code and try again.", &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
 			})
 			return nil
 		}
 
-		referrer, err := getUser(referrerID)
+		if err := a.checkReferralChain(user.Id, referrerID); err != nil {
+			_, _ = msg.Reply(b, "❌ <b>This referral can't be used:</b> "+err.Error()+".", &gotgbot.SendMessageOpts{
+				ParseMode: "HTML",
+			})
+			return nil
+		}
+
+		referrer, err := a.store.GetUser(referrerID)
 		if err != nil {
 			_, _ = msg.Reply(b, "❌ <b>The referral code is not valid.</b>\n\nPlease check with the person who referred you.", &gotgbot.SendMessageOpts{
 				ParseMode: "HTML",
@@ -290,7 +429,7 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 		}
 
 		log.Printf("Referrer ID: %d", referrer.ID)
-		err = referUser(referrerID, user.Id)
+		err = a.store.ReferUser(referrerID, user.Id)
 		if err != nil {
 			log.Printf("Failed to refer user: %v", err)
 			_, _ = msg.Reply(b, "⚠️ <b>Failed to register with the referral. Please try again.</b>", &gotgbot.SendMessageOpts{
@@ -299,23 +438,14 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 
 			return nil
 		}
-		_, _ = b.SendMessage(referrerID, fmt.Sprintf(
-			"🎉 <b>Referral Successful!</b>\n\n"+
-				"👤 You referred <b>%s</b> (%d) successfully!\n"+
-				"💵 You’ve earned <b>10.00 tokens</b>! Keep sharing and earning more! 🚀",
-			user.FirstName, user.Id), &gotgbot.SendMessageOpts{
-			ParseMode: "HTML",
-		})
-
-		err = updateUserBalance(referrerID, 10.0)
-		if err != nil {
-			log.Printf("Failed to update referrer's balance: %v", err)
+		if err := a.recordReferral(b, user, referrerID, campaignName); err != nil {
+			log.Printf("Failed to record referral: %v", err)
 		}
 	}
 
 	// Register the user (if no referrer)
 	if referrerID == 0 {
-		err = addUser(User{
+		err = a.store.AddUser(User{
 			ID:       user.Id,
 			Balance:  0,
 			Referrer: 0,
@@ -334,22 +464,25 @@ func start(b *gotgbot.Bot, ctx *ext.Context) error {
 	// Success message for the new user
 	response := fmt.Sprintf(
 		"🎉 <b>Welcome to the Refer & Earn Bot, %s!</b>\n\n"+
-			"💰 <b>Balance:</b> %.2f\n"+
+			"💰 <b>Balance:</b> %s\n"+
 			"🤝 <b>Referred Users:</b> %d\n\n"+
 			"🔗 Use your referral link to invite friends and earn rewards!",
-		user.FirstName, 0.00, 0)
+		user.FirstName, formatAmount(0), 0)
 
 	_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
-		ReplyMarkup: button,
+		ReplyMarkup: a.homeMarkup(b, user.Id),
 		ParseMode:   "HTML",
 		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
 			IsDisabled: true,
 		},
 	})
 
+	if campaign != nil {
+		a.payCampaignBonus(b, user, campaign)
+	}
 	return nil
 }
-func help(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) help(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	text := `
 <b>🤖 Bot Commands</b>
@@ -360,12 +493,19 @@ Here are the commands you can use:
 /help - 📖 Show this help message  
 /info - ℹ️ Show your user info  
 /accno - 🆔 Set or update account number 
+/code - 🔗 Show your referral link or claim a custom code  
+/top - 🏆 Show the top referrers  
 
 <b>🔸 Owner Commands</b>
 /add - ➕ Add balance  
 /remove - ➖ Remove balance  
 /stats - 📊 Show bot statistics  
 /broadcast - 📢 Broadcast a message to all users  
+/rebuild - 🧾 Rebuild balances from the ledger  
+/fsub - 📢 Manage force-subscribe channels  
+/settings - ⚙️ Rewards, token name and rate  
+/campaign - 📣 Manage referral campaigns  
+/review - 🚩 Referrals held for review  
 
 ⚠️ <i>Note: Owner commands are restricted to the bot owner only.</i>
 `
@@ -388,19 +528,19 @@ Here are the commands you can use:
 	return nil
 }
 
-func info(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) info(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	args := ctx.Args()[1:]
 	var userId int64
 
-	if len(args) == 0 {
+	if len(args) == 0 || user.Id != OwnerID {
 		userId = user.Id
 	} else {
 		userId = stringToInt64(args[0])
 	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(userId)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ <b>User not found.</b>\n\nPlease check the User ID and try again.", &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
@@ -408,15 +548,20 @@ func info(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
+	pending, confirmed := a.referralCounts(userInfo)
 	response := fmt.Sprintf(
-    "💸 <b>Per refer: .50 INR</b>\n\n"+
+    "💸 <b>Per refer: %s</b>\n\n"+
     "👤 <b>User Information</b>\n\n"+
     "🔹 <b>User ID:</b> %d\n"+
     "🔗 <b>Referrer ID:</b> %d\n"+
-    "🤝 <b>Referred Users:</b> %d\n"+
-    "💰 <b>Account Balance:</b> %.2f\n"+
+    "🤝 <b>Referred Users:</b> %d (✅ %d confirmed, ⏳ %d pending)\n"+
+    "📈 <b>Channel Joins via Your Link:</b> %d\n"+
+    "💰 <b>Account Balance:</b> %s\n"+
     "<b>Account Number</b> %d",
-    userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance, userInfo.AccNo)
+    formatAmountFiat(directReward()), userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), confirmed, pending, a.inviteJoins(userInfo.ID), formatAmountFiat(userInfo.Balance), userInfo.AccNo)
+	if achievements := a.achievementText(userInfo); achievements != "" {
+		response += "\n\n" + achievements
+	}
 
 	_, _ = msg.Reply(b, response, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
@@ -425,22 +570,17 @@ func info(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	query := ctx.CallbackQuery
-	callbackData := query.Data
-	splitData := strings.Split(callbackData, ".")
-	if len(splitData) < 2 {
-		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
-			ShowAlert: true,
-		})
+	splitData, ok := userCallbackArgs(b, ctx)
+	if !ok {
 		return nil
 	}
 
 	userId := stringToInt64(splitData[1])
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(userId)
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 			Text:      "❌ User not found.",
@@ -463,14 +603,16 @@ func infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 			},
 		},
 	}
+	pending, confirmed := a.referralCounts(userInfo)
 	response := fmt.Sprintf(
 		"👤 <b>User Information</b>\n\n"+
 			"🔹 <b>User ID:</b> %d\n"+
 			"🔗 <b>Referrer ID:</b> %d\n"+
-			"🤝 <b>Referred Users:</b> %d\n"+
-			"💰 <b>Account Balance:</b> %.2f\n"+
+			"🤝 <b>Referred Users:</b> %d (✅ %d confirmed, ⏳ %d pending)\n"+
+			"📈 <b>Channel Joins via Your Link:</b> %d\n"+
+			"💰 <b>Account Balance:</b> %s\n"+
 			"<b>Account Number</b> %d",
-		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance, userInfo.AccNo)
+		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), confirmed, pending, a.inviteJoins(userInfo.ID), formatAmountFiat(userInfo.Balance), userInfo.AccNo)
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 		Text: "ℹ️ User information loaded successfully.",
@@ -483,21 +625,16 @@ func infoCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	return nil
 }
-func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	query := ctx.CallbackQuery
-	callbackData := query.Data
 
-	splitData := strings.Split(callbackData, ".")
-	if len(splitData) < 2 {
-		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
-			ShowAlert: true,
-		})
+	splitData, ok := userCallbackArgs(b, ctx)
+	if !ok {
 		return nil
 	}
 	userId := stringToInt64(splitData[1])
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(userId)
 
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
@@ -517,13 +654,13 @@ func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 			{
 				{
 					Text:         "🆔 Set UPI ID",
-					CallbackData: fmt.Sprintf("setAccNo.%d", userInfo.ID),
+					CallbackData: userCallback("setAccNo", userInfo.ID),
 				},
 			},
 			{
 				{
 					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", userInfo.ID),
+					CallbackData: userCallback("withdraw", userInfo.ID),
 				},
 				{
 					Text:         " Home",
@@ -542,8 +679,11 @@ func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 			"🔹 <b>User ID:</b> %d\n"+
 			"🔗 <b>Referrer ID:</b> %d\n"+
 			"🤝 <b>Referred Users:</b> %d\n"+
-			"💵 <b>Account Balance:</b> %.2f",
-		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), userInfo.Balance)
+			"💵 <b>Account Balance:</b> %s",
+		userInfo.ID, userInfo.Referrer, len(userInfo.ReferredUsers), formatAmountFiat(userInfo.Balance))
+	if achievements := a.achievementText(userInfo); achievements != "" {
+		response += "\n\n" + achievements
+	}
 
 	_, _, _ = msg.EditText(b, response, &gotgbot.EditMessageTextOpts{
 		ReplyMarkup: button,
@@ -553,7 +693,7 @@ func walletCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	if user.Id != OwnerID {
@@ -563,7 +703,7 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	args := ctx.Args()[1:]
 	if len(args) < 2 {
-		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/add &lt;user_id&gt; &lt;amount&gt;</code>", &gotgbot.SendMessageOpts{
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/add &lt;user_id&gt; &lt;amount&gt; [reason]</code>", &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -581,13 +721,13 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	err = updateUserBalance(userId, amount)
+	_, err = a.creditBalance(userId, amount, TxAdminAdd, user.Id, strings.Join(args[2:], " "))
 	if err != nil {
 		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update balance: %v", err), nil)
 		return nil
 	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(userId)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
 		return nil
@@ -595,9 +735,9 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	text := fmt.Sprintf(
 		"✅ Successfully updated balance for user <b>%d</b>.\n\n"+
-			"🔹 <b>Amount Added:</b> %.2f\n"+
-			"💵 <b>New Balance:</b> %.2f",
-		userId, amount, userInfo.Balance,
+			"🔹 <b>Amount Added:</b> %s\n"+
+			"💵 <b>New Balance:</b> %s",
+		userId, formatAmount(amount), formatAmount(userInfo.Balance),
 	)
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
@@ -606,7 +746,7 @@ func addBalance(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 
@@ -617,7 +757,7 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	args := ctx.Args()[1:]
 	if len(args) < 2 {
-		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/remove &lt;user_id&gt; &lt;amount&gt;</code>", &gotgbot.SendMessageOpts{
+		_, _ = msg.Reply(b, "❌ Invalid arguments.\n\nUsage: <code>/remove &lt;user_id&gt; &lt;amount&gt; [reason]</code>", &gotgbot.SendMessageOpts{
 			ParseMode: "HTML",
 		})
 		return nil
@@ -635,13 +775,13 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	_, err = removeBalance(userId, amount)
+	_, err = a.debitBalance(userId, amount, TxAdminRemove, user.Id, strings.Join(args[2:], " "))
 	if err != nil {
 		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update balance: %v", err), nil)
 		return nil
 	}
 
-	userInfo, err := getUser(userId)
+	userInfo, err := a.store.GetUser(userId)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
 		return nil
@@ -649,9 +789,9 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	text := fmt.Sprintf(
 		"✅ Successfully updated balance for user <b>%d</b>.\n\n"+
-			"🔹 <b>Amount Deducted:</b> %.2f\n"+
-			"💵 <b>New Balance:</b> %.2f",
-		userId, amount, userInfo.Balance,
+			"🔹 <b>Amount Deducted:</b> %s\n"+
+			"💵 <b>New Balance:</b> %s",
+		userId, formatAmount(amount), formatAmount(userInfo.Balance),
 	)
 	_, _ = msg.Reply(b, text, &gotgbot.SendMessageOpts{
 		ParseMode: "HTML",
@@ -660,7 +800,7 @@ func removeBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	args := ctx.Args()[1:]
@@ -676,13 +816,13 @@ func updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	err := updateUserAccNo(user.Id, accNo)
+	err := a.store.UpdateAccNo(user.Id, accNo)
 	if err != nil {
 		_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to update account number: %v", err), nil)
 		return nil
 	}
 
-	userInfo, err := getUser(user.Id)
+	userInfo, err := a.store.GetUser(user.Id)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Failed to retrieve updated user information.", nil)
 		return nil
@@ -700,7 +840,7 @@ func updateAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func stats(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) stats(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	if user.Id != OwnerID {
@@ -708,13 +848,13 @@ func stats(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	allUser, _ := getAllUsers()
+	allUser, _ := a.store.GetAllUsers()
 	text := fmt.Sprintf("Total Users: %d\n\n", len(allUser))
 	_, _ = msg.Reply(b, text, nil)
 	return nil
 }
 
-func broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	if msg.Chat.Type != "private" {
 		return nil
@@ -739,7 +879,7 @@ func broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
 		button.InlineKeyboard = reply.ReplyMarkup.InlineKeyboard
 	}
 
-	users, err := getAllUsers()
+	users, err := a.store.GetAllUsers()
 	if err != nil {
 		_, _ = msg.Reply(b, "Error getting users.\n\n"+CustomError(err).Error(), nil)
 		return err
@@ -765,7 +905,59 @@ func broadcast(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func cancel(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) rebuildBalanceCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if user.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	args := ctx.Args()[1:]
+	if len(args) > 0 {
+		userId := stringToInt64(args[0])
+		if userId <= 0 {
+			_, _ = msg.Reply(b, "❌ Invalid user ID. Please enter a valid numeric user ID.", nil)
+			return nil
+		}
+
+		balance, err := a.store.RebuildBalance(userId)
+		if err != nil {
+			_, _ = msg.Reply(b, fmt.Sprintf("❌ Failed to rebuild balance: %v", err), nil)
+			return nil
+		}
+
+		_, _ = msg.Reply(b, fmt.Sprintf("✅ Balance for user <b>%d</b> rebuilt from the ledger.\n\n💵 <b>Balance:</b> %s", userId, formatAmount(balance)), &gotgbot.SendMessageOpts{
+			ParseMode: "HTML",
+		})
+		return nil
+	}
+
+	users, err := a.store.GetAllUsers()
+	if err != nil {
+		_, _ = msg.Reply(b, "Error getting users.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+
+	rebuilt := 0
+	for _, u := range users {
+		if _, err := a.store.RebuildBalance(u.ID); err != nil {
+			log.Printf("Failed to rebuild balance for user %d: %v", u.ID, err)
+			continue
+		}
+		rebuilt++
+	}
+
+	_, _ = msg.Reply(b, fmt.Sprintf("✅ <b>Rebuilt balances for %d/%d users</b>", rebuilt, len(users)), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
+
+func (a *app) cancel(b *gotgbot.Bot, ctx *ext.Context) error {
+	// A rejection reason that was never sent must not be applied later.
+	a.takePendingRejection(ctx.EffectiveUser.Id)
+
 	button := &gotgbot.InlineKeyboardMarkup{
 		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
 			{
@@ -789,12 +981,16 @@ func cancel(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.EndConversation()
 }
 
-func setAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) setAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	query := ctx.CallbackQuery
 
-	_, err := getUser(user.Id)
+	if _, ok := userCallbackArgs(b, ctx); !ok {
+		return handlers.EndConversation()
+	}
+
+	_, err := a.store.GetUser(user.Id)
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 			Text:      "❌ User not found.",
@@ -824,11 +1020,11 @@ func setAccNo(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.NextConversationState(SetAcc)
 }
 
-func setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 
-	_, err := getUser(user.Id)
+	_, err := a.store.GetUser(user.Id)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ User not found.", nil)
 		return nil
@@ -840,7 +1036,7 @@ func setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	err = updateUserAccNo(user.Id, accNoInt64)
+	err = a.store.UpdateAccNo(user.Id, accNoInt64)
 	if err != nil {
 		log.Printf("Error while setting account number for user %d: %v", user.Id, err)
 		_, _ = msg.Reply(b, "❌ Something went wrong while processing your request. Please try again.", nil)
@@ -851,12 +1047,16 @@ func setAccAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.EndConversation()
 }
 
-func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	query := ctx.Update.CallbackQuery
 	user := ctx.EffectiveUser
 
-	userInfo, err := getUser(user.Id)
+	if _, ok := userCallbackArgs(b, ctx); !ok {
+		return handlers.EndConversation()
+	}
+
+	userInfo, err := a.store.GetUser(user.Id)
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 			Text:      "❌ User not found.",
@@ -895,7 +1095,7 @@ func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 		ShowAlert: true,
 	})
 
-	_, _, err = msg.EditText(b, "💸 Please send the amount you wish to withdraw.\nFor cancel use /cancel", &gotgbot.EditMessageTextOpts{
+	_, _, err = msg.EditText(b, fmt.Sprintf("💸 Please send the amount of %s you wish to withdraw.\nFor cancel use /cancel", settings().TokenName), &gotgbot.EditMessageTextOpts{
 		ParseMode: "html",
 	})
 
@@ -909,7 +1109,7 @@ func withdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 	return handlers.NextConversationState(WITHDRAWAL)
 }
 
-func withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
 	text := msg.GetText()
@@ -922,7 +1122,7 @@ func withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 
 	// Get user data
-	userInfo, err := getUser(user.Id)
+	userInfo, err := a.store.GetUser(user.Id)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Something went wrong. "+CustomError(err).Error()+" Please try again later.", nil)
 		return handlers.EndConversation()
@@ -934,87 +1134,136 @@ func withdrawalAsk(b *gotgbot.Bot, ctx *ext.Context) error {
 		return handlers.NextConversationState(WITHDRAWAL)
 	}
 
-	// Remove balance from user account
-	_, err = removeBalance(msg.From.Id, amount)
+	// Debit the balance and persist the request; the debit itself is the authoritative balance check
+	request, err := a.createWithdrawal(user.Id, user.FirstName, amount, userInfo.AccNo)
+	if errors.Is(err, ErrInsufficientBalance) {
+		_, _ = msg.Reply(b, "❌ Insufficient balance. 💳 Please try again with a valid amount.", nil)
+		return handlers.NextConversationState(WITHDRAWAL)
+	}
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Failed to process your withdrawal request. "+err.Error(), nil)
 		return handlers.EndConversation()
 	}
 
-	// Send confirmation button
-	button := gotgbot.InlineKeyboardMarkup{
-		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
-			{
-				{
-					Text:         "✅ Confirm Withdrawal",
-					CallbackData: fmt.Sprintf("confirm_withdrawal.%d.%f", user.Id, amount),
-				},
-			},
-		},
-	}
-
-	// Log the withdrawal request
-	loggerMsg := fmt.Sprintf("💰 <b>%s</b> requested a withdrawal of %.2f\n\nUser AccNo: <code>%d</code>", user.FirstName, amount, userInfo.AccNo)
-
-	// Send to logger
-	_, err = b.SendMessage(LoggerID, loggerMsg, &gotgbot.SendMessageOpts{ReplyMarkup: button, ParseMode: "html"})
+	// Send to logger with the admin actions
+	_, err = b.SendMessage(LoggerID, withdrawalText(request), &gotgbot.SendMessageOpts{ReplyMarkup: withdrawalMarkup(request), ParseMode: "html"})
 	if err != nil {
-		_, _ = msg.Reply(b, "❌ Failed to send withdrawal request to the logger. "+CustomError(err).Error(), nil)
+		// No admin would ever see the request, so give the money back.
+		log.Printf("Failed to send withdrawal %s to the logger: %v", request.ID.Hex(), err)
+		if _, err := a.transitionWithdrawal(request.ID.Hex(), WithdrawalCancelled, user.Id, "logger unreachable"); err != nil {
+			log.Printf("Failed to cancel withdrawal %s: %v", request.ID.Hex(), err)
+			_, _ = msg.Reply(b, "❌ Failed to send withdrawal request to the logger. Please contact the owner.", nil)
+			return handlers.EndConversation()
+		}
+		_, _ = msg.Reply(b, "❌ Your withdrawal request couldn't be submitted, so the amount was returned to your balance. Please try again later.", nil)
 		return handlers.EndConversation()
 	}
 
-	_, _ = msg.Reply(b, "🎉 Withdrawal Request Submitted! 🎉\n\n- 🕒 Processing Time: Please allow a few hours for our team to review and approve your request.", nil)
+	_, err = msg.Reply(b, "🎉 Withdrawal Request Submitted! 🎉\n\n- 🕒 Processing Time: Please allow a few hours for our team to review and approve your request.", &gotgbot.SendMessageOpts{
+		ReplyMarkup: cancelMarkup(request),
+	})
+	if err != nil {
+		log.Printf("Failed to confirm withdrawal %s to %d: %v", request.ID.Hex(), user.Id, err)
+	}
 
 	return handlers.EndConversation()
 }
 
-func confirmWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+// cancelWithdrawal lets the user cancel a request no admin has acted on yet,
+// which returns the amount to their balance.
+func (a *app) cancelWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
-	query := ctx.Update.CallbackQuery
-	data := query.Data
+	query := ctx.CallbackQuery
+
+	args, ok := callbackArgs(b, query)
+	if !ok || len(args) < 2 {
+		return nil
+	}
 
-	splitData := strings.Split(data, ".")
-	if len(splitData) < 3 {
+	request, err := a.getWithdrawal(args[1])
+	if err != nil || request.UserID != query.From.Id {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid callback data.",
+			Text:      "❌ Withdrawal request not found.",
 			ShowAlert: true,
 		})
 		return nil
 	}
 
-	userID, err := strconv.ParseInt(splitData[1], 10, 64)
+	request, err = a.transitionWithdrawal(args[1], WithdrawalCancelled, query.From.Id, "cancelled by the user")
+	if errors.Is(err, ErrInvalidTransition) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "⚠️ This withdrawal is already being processed and can't be cancelled.",
+			ShowAlert: true,
+		})
+		return nil
+	}
 	if err != nil {
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid user ID.",
+			Text:      "❌ Failed to cancel the withdrawal.",
 			ShowAlert: true,
 		})
+		return fmt.Errorf("cancelWithdrawal: %v", err)
+	}
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text: "✅ Withdrawal cancelled.",
+	})
+	_, _, _ = msg.EditText(b, fmt.Sprintf("🚫 Withdrawal Cancelled\n\n💸 %s has been returned to your balance.", formatAmountFiat(request.Amount)), nil)
+
+	_, _ = b.SendMessage(LoggerID, withdrawalText(request), &gotgbot.SendMessageOpts{ParseMode: "html"})
+	return nil
+}
+
+func (a *app) confirmWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.Update.CallbackQuery
+
+	splitData, ok := callbackArgs(b, query)
+	if !ok || len(splitData) < 2 {
 		return nil
 	}
 
-	amount, err := strconv.ParseFloat(splitData[2], 64)
-	if err != nil {
+	if !a.requireFinanceAdmin(b, query, "approve_withdrawal", splitData[1]) {
+		return nil
+	}
+
+	request, err := a.transitionWithdrawal(splitData[1], WithdrawalApproved, query.From.Id, "")
+	if errors.Is(err, ErrInvalidTransition) {
+		a.audit(&query.From, msg.Chat.Id, "approve_withdrawal", splitData[1], false, err.Error())
 		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
-			Text:      "❌ Invalid amount.",
+			Text:      "⚠️ This withdrawal has already been processed.",
 			ShowAlert: true,
 		})
 		return nil
 	}
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ Withdrawal request not found.",
+			ShowAlert: true,
+		})
+		return fmt.Errorf("confirmWithdrawal: %v", err)
+	}
+
+	a.audit(&query.From, msg.Chat.Id, "approve_withdrawal", splitData[1], true, "")
 
 	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 		Text: "✅ Processing withdrawal request...",
 	})
 
-	_, _, _ = msg.EditText(b, fmt.Sprintf("✅ Done! Amount of %.2f successfully withdrawn.", amount), nil)
+	_, _, _ = msg.EditText(b, withdrawalText(request), &gotgbot.EditMessageTextOpts{
+		ParseMode:   "html",
+		ReplyMarkup: *withdrawalMarkup(request),
+	})
 
 	text := fmt.Sprintf(`🎉 Withdrawal Approved! 🎉
 
 ✅ Your withdrawal request has been successfully approved!
 
-💸 Amount: %.2f
+💸 Amount: %s
 
-Thank you for trusting us! 🚀`, amount)
+Thank you for trusting us! 🚀`, formatAmountFiat(request.Amount))
 
-	_, err = b.SendMessage(userID, text, nil)
+	_, err = b.SendMessage(request.UserID, text, nil)
 	if err != nil {
 		_, _ = msg.Reply(b, "❌ Failed to send the approved withdrawal message. "+CustomError(err).Error(), nil)
 	}
@@ -1022,14 +1271,168 @@ Thank you for trusting us! 🚀`, amount)
 	return nil
 }
 
-func home(b *gotgbot.Bot, ctx *ext.Context) error {
+func (a *app) paidWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.Update.CallbackQuery
+
+	splitData, ok := callbackArgs(b, query)
+	if !ok || len(splitData) < 2 {
+		return nil
+	}
+
+	if !a.requireFinanceAdmin(b, query, "pay_withdrawal", splitData[1]) {
+		return nil
+	}
+
+	request, err := a.transitionWithdrawal(splitData[1], WithdrawalPaid, query.From.Id, "")
+	if errors.Is(err, ErrInvalidTransition) {
+		a.audit(&query.From, msg.Chat.Id, "pay_withdrawal", splitData[1], false, err.Error())
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "⚠️ This withdrawal has already been processed.",
+			ShowAlert: true,
+		})
+		return nil
+	}
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ Withdrawal request not found.",
+			ShowAlert: true,
+		})
+		return fmt.Errorf("paidWithdrawal: %v", err)
+	}
+
+	a.audit(&query.From, msg.Chat.Id, "pay_withdrawal", splitData[1], true, "")
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text: "✅ Marked as paid.",
+	})
+
+	_, _, _ = msg.EditText(b, withdrawalText(request), &gotgbot.EditMessageTextOpts{
+		ParseMode: "html",
+	})
+
+	text := fmt.Sprintf("💸 <b>Payment Sent!</b>\n\n%s has been paid to your account <code>%d</code>.", formatAmountFiat(request.Amount), request.AccNo)
+	_, err = b.SendMessage(request.UserID, text, &gotgbot.SendMessageOpts{ParseMode: "html"})
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to send the payment message. "+CustomError(err).Error(), nil)
+	}
+
+	return nil
+}
+
+func (a *app) rejectWithdrawal(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	query := ctx.Update.CallbackQuery
+
+	splitData, ok := callbackArgs(b, query)
+	if !ok || len(splitData) < 2 {
+		return handlers.EndConversation()
+	}
+
+	if !a.requireFinanceAdmin(b, query, "reject_withdrawal", splitData[1]) {
+		return handlers.EndConversation()
+	}
+
+	request, err := a.getWithdrawal(splitData[1])
+	if err != nil {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "❌ Withdrawal request not found.",
+			ShowAlert: true,
+		})
+		return handlers.EndConversation()
+	}
+
+	if !canTransition(request.Status, WithdrawalRejected) {
+		_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "⚠️ This withdrawal has already been processed.",
+			ShowAlert: true,
+		})
+		return handlers.EndConversation()
+	}
+
+	a.setPendingRejection(query.From.Id, pendingRejection{
+		withdrawalID: request.ID.Hex(),
+		chatID:       msg.Chat.Id,
+		messageID:    msg.MessageId,
+	})
+
+	_, _ = query.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+		Text: "📝 Send the rejection reason.",
+	})
+
+	_, err = msg.Reply(b, "📝 Send the reason for rejecting this withdrawal, or <code>-</code> to reject without a reason.\nTo cancel, click /cancel .", &gotgbot.SendMessageOpts{
+		ParseMode:   "html",
+		ReplyMarkup: gotgbot.ForceReply{ForceReply: true, Selective: true},
+	})
+	if err != nil {
+		log.Printf("Error while asking for rejection reason: %v", err)
+		return handlers.EndConversation()
+	}
+
+	return handlers.NextConversationState(RejectReason)
+}
+
+func (a *app) rejectWithdrawalReason(b *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	user := ctx.EffectiveUser
-	quary := ctx.CallbackQuery
 
-	referUrl := fmt.Sprintf("https://t.me/%s?start=%d", b.User.Username, user.Id)
+	pending, ok := a.takePendingRejection(user.Id)
+	if !ok {
+		_, _ = msg.Reply(b, "❌ No withdrawal is waiting for a rejection reason.", nil)
+		return handlers.EndConversation()
+	}
+	if !isFinanceAdmin(user.Id) {
+		a.audit(user, msg.Chat.Id, "reject_withdrawal", pending.withdrawalID, false, msg.Text)
+		_, _ = msg.Reply(b, "⛔ You are not authorized to do this.", nil)
+		return handlers.EndConversation()
+	}
 
-	button := gotgbot.InlineKeyboardMarkup{
+	reason := strings.TrimSpace(msg.Text)
+	if reason == "-" {
+		reason = ""
+	}
+
+	request, err := a.transitionWithdrawal(pending.withdrawalID, WithdrawalRejected, user.Id, reason)
+	if errors.Is(err, ErrInvalidTransition) {
+		a.audit(user, msg.Chat.Id, "reject_withdrawal", pending.withdrawalID, false, err.Error())
+		_, _ = msg.Reply(b, "⚠️ This withdrawal has already been processed.", nil)
+		return handlers.EndConversation()
+	}
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to reject the withdrawal. "+CustomError(err).Error(), nil)
+		return handlers.EndConversation()
+	}
+
+	a.audit(user, msg.Chat.Id, "reject_withdrawal", pending.withdrawalID, true, reason)
+
+	_, _, _ = b.EditMessageText(withdrawalText(request), &gotgbot.EditMessageTextOpts{
+		ChatId:    pending.chatID,
+		MessageId: pending.messageID,
+		ParseMode: "html",
+	})
+
+	_, _ = msg.Reply(b, fmt.Sprintf("✅ Withdrawal rejected and %s refunded to user <code>%d</code>.", formatAmount(request.Amount), request.UserID), &gotgbot.SendMessageOpts{
+		ParseMode: "html",
+	})
+
+	text := fmt.Sprintf("❌ <b>Withdrawal Rejected</b>\n\n💸 <b>Amount:</b> %s\n💰 The amount has been returned to your balance.", formatAmount(request.Amount))
+	if reason != "" {
+		text += fmt.Sprintf("\n\n📝 <b>Reason:</b> %s", html.EscapeString(reason))
+	}
+
+	_, err = b.SendMessage(request.UserID, text, &gotgbot.SendMessageOpts{ParseMode: "html"})
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to notify the user. "+CustomError(err).Error(), nil)
+	}
+
+	return handlers.EndConversation()
+}
+
+// homeMarkup is the main menu shown by /start and the Home button.
+func (a *app) homeMarkup(b *gotgbot.Bot, userID int64) gotgbot.InlineKeyboardMarkup {
+	referUrl := a.referralLink(b, userID)
+
+	return gotgbot.InlineKeyboardMarkup{
 		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
 			{
 				{
@@ -1044,32 +1447,46 @@ func home(b *gotgbot.Bot, ctx *ext.Context) error {
 				},
 				{
 					Text:         "ℹ️ Info",
-					CallbackData: fmt.Sprintf("info.%d", user.Id),
+					CallbackData: userCallback("info", userID),
 				},
 			},
 			{
 				{
 					Text:         "💼 Wallet",
-					CallbackData: fmt.Sprintf("wallet.%d", user.Id),
+					CallbackData: userCallback("wallet", userID),
 				},
 				{
 					Text:         "💸 Withdraw",
-					CallbackData: fmt.Sprintf("withdraw.%d", user.Id),
+					CallbackData: userCallback("withdraw", userID),
+				},
+			},
+			{
+				{
+					Text:         "🏆 Leaderboard",
+					CallbackData: userCallback("top", userID),
 				},
 			},
 		},
 	}
+}
+
+func (a *app) home(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	quary := ctx.CallbackQuery
+
+	button := a.homeMarkup(b, user.Id)
 	_, _ = quary.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
 		Text: "🔙 Back to Main Menu",
 	})
 
-	existingUser, _ := getUser(user.Id)
+	existingUser, _ := a.store.GetUser(user.Id)
 	response := fmt.Sprintf(
 		"👋 <b>Welcome back, %s!</b>\n\n"+
-			"💰 <b>Balance:</b> %.2f\n"+
+			"💰 <b>Balance:</b> %s\n"+
 			"🤝 <b>Referred Users:</b> %d\n\n"+
 			"🚀 Keep earning rewards by referring your friends!",
-		user.FirstName, existingUser.Balance, len(existingUser.ReferredUsers))
+		user.FirstName, formatAmountFiat(existingUser.Balance), len(existingUser.ReferredUsers))
 
 	_, _, _ = msg.EditText(b, response, &gotgbot.EditMessageTextOpts{
 		ParseMode:   "HTML",
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Membership event kinds.
+const (
+	MemberJoined = "join"
+	MemberLeft   = "leave"
+)
+
+// Leave policies applied to the referrer when a referee leaves an fsub
+// channel within LeaveWindow of being referred.
+const (
+	LeavePolicyOff     = "off"
+	LeavePolicyReverse = "reverse"
+	LeavePolicyFreeze  = "freeze"
+)
+
+// MembershipEvent records a user joining or leaving a force-subscribe channel.
+type MembershipEvent struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID     int64              `bson:"user_id" json:"user_id"`
+	ChatID     int64              `bson:"chat_id" json:"chat_id"`
+	Event      string             `bson:"event" json:"event"`
+	InviteLink string             `bson:"invite_link,omitempty" json:"invite_link,omitempty"`
+	// ReferrerID is the owner of InviteLink, when the join came through a referral link.
+	ReferrerID int64     `bson:"referrer_id,omitempty" json:"referrer_id,omitempty"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+func parseLeavePolicy(s string) (string, error) {
+	switch s {
+	case "", LeavePolicyOff:
+		return LeavePolicyOff, nil
+	case LeavePolicyReverse, LeavePolicyFreeze:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown leave policy %q", s)
+	}
+}
+
+// chatMemberUpdate records joins and leaves in force-subscribe channels and
+// applies the leave policy to the referee's referrer.
+func (a *app) chatMemberUpdate(b *gotgbot.Bot, ctx *ext.Context) error {
+	update := ctx.ChatMember
+	if !containsInt64(fsubChannels(), update.Chat.Id) {
+		return nil
+	}
+
+	user := update.NewChatMember.GetUser()
+	wasMember := memberStatuses[update.OldChatMember.MergeChatMember().Status]
+	isMember := memberStatuses[update.NewChatMember.MergeChatMember().Status]
+	if wasMember == isMember {
+		return nil
+	}
+
+	event := MembershipEvent{
+		UserID:    user.Id,
+		ChatID:    update.Chat.Id,
+		Event:     MemberJoined,
+		CreatedAt: time.Now(),
+	}
+	if !isMember {
+		event.Event = MemberLeft
+	}
+	if update.InviteLink != nil {
+		event.InviteLink = update.InviteLink.InviteLink
+	}
+
+	memberCacheMutex.Lock()
+	delete(memberCache, memberKey{chatID: update.Chat.Id, userID: user.Id})
+	memberCacheMutex.Unlock()
+
+	// Any join request has been approved, or no longer matters.
+	if err := a.store.DeleteJoinRequest(update.Chat.Id, user.Id); err != nil {
+		log.Printf("Failed to delete join request of %d: %v", user.Id, err)
+	}
+
+	if isMember {
+		previous, err := a.store.MembershipEvents(user.Id)
+		if err != nil {
+			return fmt.Errorf("chatMemberUpdate: %v", err)
+		}
+
+		invite, err := a.attributeJoin(event, previous)
+		if err != nil {
+			log.Printf("Failed to attribute join of %d: %v", user.Id, err)
+		} else if invite != nil {
+			event.ReferrerID = invite.OwnerID
+		}
+	}
+
+	if err := a.store.RecordMembershipEvent(event); err != nil {
+		return fmt.Errorf("chatMemberUpdate: %v", err)
+	}
+
+	if isMember {
+		return a.releaseFrozenReward(b, update.Chat.Id, user.Id)
+	}
+	return a.applyLeavePolicy(b, user.Id)
+}
+
+// referralReward finds the ledger entry that paid the referrer for userID.
+func (a *app) referralReward(userID int64) (*User, *Transaction, error) {
+	referee, err := a.store.GetUser(userID)
+	if err != nil || referee.Referrer == 0 {
+		return nil, nil, nil
+	}
+
+	txs, err := a.store.Transactions(referee.Referrer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range txs {
+		if txs[i].Type == TxReferral && txs[i].ActorID == userID {
+			return referee, &txs[i], nil
+		}
+	}
+	return referee, nil, nil
+}
+
+func (a *app) applyLeavePolicy(b *gotgbot.Bot, userID int64) error {
+	if LeavePolicy == LeavePolicyOff {
+		return nil
+	}
+
+	referee, reward, err := a.referralReward(userID)
+	if err != nil {
+		return fmt.Errorf("applyLeavePolicy: %v", err)
+	}
+	if reward == nil || time.Since(reward.CreatedAt) > LeaveWindow {
+		return nil
+	}
+
+	// Skip rewards that were already reversed, or frozen and not yet released.
+	if referee.RewardHold != "" {
+		return nil
+	}
+
+	referrer, err := a.store.GetUser(referee.Referrer)
+	if err != nil {
+		return fmt.Errorf("applyLeavePolicy: %v", err)
+	}
+
+	// The referrer may have spent part of the reward already.
+	amount := reward.Amount
+	if referrer.Balance < amount {
+		amount = referrer.Balance
+	}
+	if amount <= 0 {
+		log.Printf("Referee %d left but referrer %d has no balance to claw back", userID, referrer.ID)
+		return nil
+	}
+
+	txType, title, text := TxReferralReversal, "Reversed", "reversed"
+	if LeavePolicy == LeavePolicyFreeze {
+		txType, title, text = TxReferralFreeze, "Frozen", "frozen until they rejoin"
+	}
+
+	// The store marks the referee in the same unit as the debit, so leaves
+	// from several channels or redelivered updates claw back only once.
+	entry := Transaction{Type: txType, ActorID: userID, Reason: fmt.Sprintf("referee %d left the channel", userID)}
+	_, err = a.store.HoldReferralReward(userID, referrer.ID, amount, entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("applyLeavePolicy: %v", err)
+	}
+
+	_, _ = b.SendMessage(referrer.ID, fmt.Sprintf(
+		"⚠️ <b>Referral Reward %s</b>\n\n"+
+			"👤 User <code>%d</code> left the channel within %d days of joining.\n"+
+			"💸 <b>%s</b> of your reward have been %s.",
+		title, userID, int(LeaveWindow.Hours()/24), formatAmount(amount), text), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
+
+// inOtherChannels reports whether userID is a member of every fsub channel
+// other than chatID.
+func (a *app) inOtherChannels(b *gotgbot.Bot, chatID, userID int64) (bool, error) {
+	for _, id := range fsubChannels() {
+		if id == chatID {
+			continue
+		}
+		isMember, err := a.isChannelMember(b, id, userID)
+		if err != nil || !isMember {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// releaseFrozenReward gives a frozen referral reward back once the referee
+// has rejoined chatID and is back in every fsub channel.
+func (a *app) releaseFrozenReward(b *gotgbot.Bot, chatID, userID int64) error {
+	referee, err := a.store.GetUser(userID)
+	if err != nil || referee.RewardHold != TxReferralFreeze {
+		return nil
+	}
+
+	ok, err := a.inOtherChannels(b, chatID, userID)
+	if err != nil {
+		return fmt.Errorf("releaseFrozenReward: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	entry := Transaction{Type: TxReferralRelease, ActorID: userID, Reason: fmt.Sprintf("referee %d rejoined the channel", userID)}
+	tx, err := a.store.ReleaseReferralReward(userID, referee.Referrer, entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("releaseFrozenReward: %v", err)
+	}
+
+	_, _ = b.SendMessage(referee.Referrer, fmt.Sprintf(
+		"✅ <b>Referral Reward Released</b>\n\n"+
+			"👤 User <code>%d</code> rejoined the channel.\n"+
+			"💵 <b>%s</b> are back in your balance.",
+		userID, formatAmount(tx.Amount)), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
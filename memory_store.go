@@ -0,0 +1,755 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryStore is a thread-safe, in-memory Store used by tests.
+type memoryStore struct {
+	mu          sync.Mutex
+	users       map[int64]User
+	txs         []Transaction
+	withdrawals map[primitive.ObjectID]Withdrawal
+	audits      []AuditEntry
+	fsub        []FSubChannel
+	members     []MembershipEvent
+	invites     map[string]ReferralInvite
+	requests    map[memberKey]JoinRequest
+	settings    *Settings
+	referrals   []Referral
+	captchas    map[int64]CaptchaFailure
+	campaigns   map[string]Campaign
+}
+
+func newMemoryStore(users ...User) *memoryStore {
+	s := &memoryStore{
+		users:       make(map[int64]User),
+		withdrawals: make(map[primitive.ObjectID]Withdrawal),
+		invites:     make(map[string]ReferralInvite),
+		requests:    make(map[memberKey]JoinRequest),
+		captchas:    make(map[int64]CaptchaFailure),
+		campaigns:   make(map[string]Campaign),
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+func (s *memoryStore) GetUser(userID int64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	user.ReferredUsers = append([]int64(nil), user.ReferredUsers...)
+	return &user, nil
+}
+
+func (s *memoryStore) Credit(userID int64, amount float64, entry Transaction) (*Transaction, error) {
+	return s.applyDelta(userID, amount, entry)
+}
+
+func (s *memoryStore) Debit(userID int64, amount float64, entry Transaction) (*Transaction, error) {
+	return s.applyDelta(userID, -amount, entry)
+}
+
+func (s *memoryStore) applyDelta(userID int64, delta float64, entry Transaction) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyDeltaLocked(userID, delta, entry)
+}
+
+func (s *memoryStore) applyDeltaLocked(userID int64, delta float64, entry Transaction) (*Transaction, error) {
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("user with ID %d does not exist", userID)
+	}
+	if user.Balance+delta < 0 {
+		return nil, fmt.Errorf("%w for user %d", ErrInsufficientBalance, userID)
+	}
+
+	entry.ID = primitive.NewObjectID()
+	entry.UserID = userID
+	entry.Amount = delta
+	entry.BalanceBefore = user.Balance
+	entry.BalanceAfter = user.Balance + delta
+	entry.CreatedAt = time.Now()
+
+	user.Balance = entry.BalanceAfter
+	s.users[userID] = user
+	s.txs = append(s.txs, entry)
+	return &entry, nil
+}
+
+func (s *memoryStore) CreateWithdrawal(w Withdrawal) (*Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := Transaction{Type: TxWithdrawal, ActorID: w.UserID, Reason: "withdrawal " + w.ID.Hex()}
+	tx, err := s.applyDeltaLocked(w.UserID, -w.Amount, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	w.DebitTxID = tx.ID
+	s.withdrawals[w.ID] = w
+	return &w, nil
+}
+
+func (s *memoryStore) GetWithdrawal(id primitive.ObjectID) (*Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.withdrawals[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	w.History = append([]WithdrawalEvent(nil), w.History...)
+	return &w, nil
+}
+
+func (s *memoryStore) TransitionWithdrawal(id primitive.ObjectID, to string, actorID int64, reason string) (*Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.withdrawals[id]
+	if !ok {
+		return nil, fmt.Errorf("withdrawal %s does not exist", id.Hex())
+	}
+	if !canTransition(w.Status, to) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, w.Status, to)
+	}
+
+	if refundStates[to] {
+		entry := Transaction{Type: TxRefund, ActorID: actorID, Reason: "refund withdrawal " + id.Hex()}
+		tx, err := s.applyDeltaLocked(w.UserID, w.Amount, entry)
+		if err != nil {
+			return nil, err
+		}
+		w.RefundTxID = tx.ID
+	}
+
+	now := time.Now()
+	w.Status = to
+	w.ActedBy = actorID
+	w.Reason = reason
+	w.UpdatedAt = now
+	w.History = append(append([]WithdrawalEvent(nil), w.History...), WithdrawalEvent{Status: to, ActorID: actorID, Reason: reason, At: now})
+	s.withdrawals[id] = w
+	return &w, nil
+}
+
+func (s *memoryStore) RecordAudit(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	s.audits = append(s.audits, entry)
+	return nil
+}
+
+func (s *memoryStore) AddUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addUserLocked(user)
+}
+
+func (s *memoryStore) addUserLocked(user User) error {
+	if _, ok := s.users[user.ID]; ok {
+		return fmt.Errorf("user with ID %d already exists", user.ID)
+	}
+	s.users[user.ID] = user
+	return nil
+}
+
+func (s *memoryStore) ReferUser(referrerID, newUserID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referrer, ok := s.users[referrerID]
+	if !ok {
+		return fmt.Errorf("referrer with ID %d does not exist", referrerID)
+	}
+
+	if err := s.addUserLocked(User{ID: newUserID, Referrer: referrerID}); err != nil {
+		return err
+	}
+
+	referrer.ReferredUsers = append(append([]int64(nil), referrer.ReferredUsers...), newUserID)
+	s.users[referrerID] = referrer
+	return nil
+}
+
+func (s *memoryStore) HoldReferralReward(refereeID, referrerID int64, amount float64, entry Transaction) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referee, ok := s.users[refereeID]
+	if !ok || referee.RewardHold != "" {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	tx, err := s.applyDeltaLocked(referrerID, -amount, entry)
+	if err != nil {
+		return nil, err
+	}
+	referee.RewardHold = entry.Type
+	if entry.Type == TxReferralFreeze {
+		referee.FrozenReward = amount
+	}
+	s.users[refereeID] = referee
+	return tx, nil
+}
+
+func (s *memoryStore) ReleaseReferralReward(refereeID, referrerID int64, entry Transaction) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referee, ok := s.users[refereeID]
+	if !ok || referee.RewardHold != TxReferralFreeze {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	tx, err := s.applyDeltaLocked(referrerID, referee.FrozenReward, entry)
+	if err != nil {
+		return nil, err
+	}
+	referee.RewardHold, referee.FrozenReward = "", 0
+	s.users[refereeID] = referee
+	return tx, nil
+}
+
+func (s *memoryStore) GetAllUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		u.ReferredUsers = append([]int64(nil), u.ReferredUsers...)
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryStore) UpdateAccNo(userID, accNo int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userID]; ok {
+		user.AccNo = accNo
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) TouchUser(userID int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userID]; ok {
+		user.LastActiveAt = at
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) SetRefCode(userID int64, code string) error {
+	return s.setUserCode(userID, code, func(u *User) *string { return &u.RefCode })
+}
+
+func (s *memoryStore) SetVanityCode(userID int64, code string) error {
+	return s.setUserCode(userID, code, func(u *User) *string { return &u.VanityCode })
+}
+
+func (s *memoryStore) setUserCode(userID int64, code string, field func(*User) *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, u := range s.users {
+		if id != userID && *field(&u) == code {
+			return ErrCodeTaken
+		}
+	}
+	if user, ok := s.users[userID]; ok {
+		*field(&user) = code
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimMilestone(userID int64, referrals int, bonus float64, entry Transaction) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	for _, m := range user.Milestones {
+		if m == referrals {
+			return nil, mongo.ErrNoDocuments
+		}
+	}
+
+	tx, err := s.applyDeltaLocked(userID, bonus, entry)
+	if err != nil {
+		return nil, err
+	}
+	user = s.users[userID]
+	user.Milestones = append(append([]int(nil), user.Milestones...), referrals)
+	s.users[userID] = user
+	return tx, nil
+}
+
+func (s *memoryStore) SetHideFromTop(userID int64, hide bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userID]; ok {
+		user.HideFromTop = hide
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) UsersHiddenFromTop() ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []int64
+	for id, u := range s.users {
+		if u.HideFromTop {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) UserByCode(code string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.RefCode == code || u.VanityCode == code {
+			u.ReferredUsers = append([]int64(nil), u.ReferredUsers...)
+			return &u, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *memoryStore) RecordTransaction(entry Transaction) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	entry.CreatedAt = time.Now()
+	s.txs = append(s.txs, entry)
+	return &entry, nil
+}
+
+func (s *memoryStore) Transactions(userID int64) ([]Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.transactionsLocked(userID), nil
+}
+
+func (s *memoryStore) transactionsLocked(userID int64) []Transaction {
+	var txs []Transaction
+	for _, tx := range s.txs {
+		if tx.UserID == userID {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+func (s *memoryStore) RebuildBalance(userID int64) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return 0, fmt.Errorf("user with ID %d does not exist", userID)
+	}
+
+	user.Balance = ledgerBalance(s.transactionsLocked(userID))
+	s.users[userID] = user
+	return user.Balance, nil
+}
+
+func (s *memoryStore) FSubChannels() ([]FSubChannel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]FSubChannel(nil), s.fsub...), nil
+}
+
+func (s *memoryStore) AddFSubChannel(ch FSubChannel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.fsub {
+		if existing.ID == ch.ID {
+			s.fsub[i] = ch
+			return nil
+		}
+	}
+	s.fsub = append(s.fsub, ch)
+	return nil
+}
+
+func (s *memoryStore) RemoveFSubChannel(chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, ch := range s.fsub {
+		if ch.ID == chatID {
+			s.fsub = append(s.fsub[:i], s.fsub[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("channel %d is not a force-subscribe channel", chatID)
+}
+
+func (s *memoryStore) RecordMembershipEvent(event MembershipEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = primitive.NewObjectID()
+	s.members = append(s.members, event)
+	return nil
+}
+
+func (s *memoryStore) MembershipEvents(userID int64) ([]MembershipEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []MembershipEvent
+	for _, e := range s.members {
+		if e.UserID == userID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) SaveInviteLink(invite ReferralInvite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.invites[invite.Link]; ok {
+		return fmt.Errorf("invite link %s already exists", invite.Link)
+	}
+	s.invites[invite.Link] = invite
+	return nil
+}
+
+func (s *memoryStore) InviteLink(link string) (*ReferralInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite, ok := s.invites[link]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &invite, nil
+}
+
+func (s *memoryStore) FindInviteLink(chatID, ownerID int64, campaign string, joinRequest bool) (*ReferralInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, invite := range s.invites {
+		if invite.ChatID == chatID && invite.OwnerID == ownerID && invite.Campaign == campaign && invite.JoinRequest == joinRequest {
+			return &invite, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *memoryStore) InviteLinksByOwner(ownerID int64) ([]ReferralInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var invites []ReferralInvite
+	for _, invite := range s.invites {
+		if invite.OwnerID == ownerID {
+			invites = append(invites, invite)
+		}
+	}
+	return invites, nil
+}
+
+func (s *memoryStore) IncrementInviteJoins(link string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite, ok := s.invites[link]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+	invite.Joins++
+	s.invites[link] = invite
+	return nil
+}
+
+func (s *memoryStore) SaveJoinRequest(req JoinRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[memberKey{chatID: req.ChatID, userID: req.UserID}] = req
+	return nil
+}
+
+func (s *memoryStore) JoinRequest(chatID, userID int64) (*JoinRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.requests[memberKey{chatID: chatID, userID: userID}]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &req, nil
+}
+
+func (s *memoryStore) DeleteJoinRequest(chatID, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.requests, memberKey{chatID: chatID, userID: userID})
+	return nil
+}
+
+func (s *memoryStore) GetSettings() (*Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settings == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	settings := *s.settings
+	return &settings, nil
+}
+
+func (s *memoryStore) SaveSettings(settings Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.settings = &settings
+	return nil
+}
+
+func (s *memoryStore) CreateReferral(r Referral) (*Referral, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = primitive.NewObjectID()
+	s.referrals = append(s.referrals, r)
+	return &r, nil
+}
+
+func (s *memoryStore) GetReferral(id primitive.ObjectID) (*Referral, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.referrals {
+		if r.ID == id {
+			return &r, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (s *memoryStore) TransitionReferral(id primitive.ObjectID, from, to, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.referrals {
+		if r.ID != id {
+			continue
+		}
+		if r.Status != from {
+			return mongo.ErrNoDocuments
+		}
+		s.referrals[i].Status = to
+		s.referrals[i].Reason = reason
+		s.referrals[i].SettledAt = time.Now()
+		return nil
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (s *memoryStore) FlagReferral(id primitive.ObjectID, score int, signals []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.referrals {
+		if r.ID == id {
+			s.referrals[i].FraudScore = score
+			s.referrals[i].FraudSignals = append([]string(nil), signals...)
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (s *memoryStore) DueReferrals(now time.Time) ([]Referral, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Referral
+	for _, r := range s.referrals {
+		if r.Status == ReferralPending && !r.QualifiesAt.After(now) {
+			due = append(due, r)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStore) ReferralsByReferrer(referrerID int64) ([]Referral, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var referrals []Referral
+	for _, r := range s.referrals {
+		if r.ReferrerID == referrerID {
+			referrals = append(referrals, r)
+		}
+	}
+	return referrals, nil
+}
+
+func (s *memoryStore) ReferralsByStatus(status string) ([]Referral, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var referrals []Referral
+	for _, r := range s.referrals {
+		if r.Status == status {
+			referrals = append(referrals, r)
+		}
+	}
+	return referrals, nil
+}
+
+func (s *memoryStore) ReferrerRanks(since time.Time) ([]leaderRank, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := map[int64]int{}
+	for _, r := range s.referrals {
+		if r.Status == ReferralConfirmed && !r.SettledAt.Before(since) {
+			counts[r.ReferrerID]++
+		}
+	}
+
+	ranks := make([]leaderRank, 0, len(counts))
+	for id, n := range counts {
+		ranks = append(ranks, leaderRank{UserID: id, Referrals: n})
+	}
+	sort.Slice(ranks, func(i, j int) bool {
+		if ranks[i].Referrals != ranks[j].Referrals {
+			return ranks[i].Referrals > ranks[j].Referrals
+		}
+		return ranks[i].UserID < ranks[j].UserID
+	})
+	return ranks, nil
+}
+
+func (s *memoryStore) RecordCaptchaFailure(userID int64, at time.Time) (*CaptchaFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.captchas[userID]
+	f.UserID = userID
+	f.Count++
+	f.LastFailedAt = at
+	s.captchas[userID] = f
+	return &f, nil
+}
+
+func (s *memoryStore) CaptchaFailures(userID int64) (*CaptchaFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.captchas[userID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &f, nil
+}
+
+func (s *memoryStore) SaveCampaign(c Campaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.campaigns[c.Code] = c
+	return nil
+}
+
+func (s *memoryStore) GetCampaign(code string) (*Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.campaigns[code]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &c, nil
+}
+
+func (s *memoryStore) Campaigns() ([]Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaigns := make([]Campaign, 0, len(s.campaigns))
+	for _, c := range s.campaigns {
+		campaigns = append(campaigns, c)
+	}
+	sort.Slice(campaigns, func(i, j int) bool { return campaigns[i].CreatedAt.After(campaigns[j].CreatedAt) })
+	return campaigns, nil
+}
+
+func (s *memoryStore) EndCampaign(code string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.campaigns[code]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+	c.EndsAt = at
+	if c.StartsAt.After(at) {
+		c.StartsAt = at
+	}
+	s.campaigns[code] = c
+	return nil
+}
+
+func (s *memoryStore) RecordCampaignSignup(code string, bonus float64, now time.Time) (*Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.campaigns[code]
+	if !ok || !c.active(now) {
+		return nil, mongo.ErrNoDocuments
+	}
+	c.Signups++
+	c.BonusPaid += bonus
+	s.campaigns[code] = c
+	return &c, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// progressBarWidth is how many cells the progress bar to the next badge has.
+const progressBarWidth = 10
+
+// Milestone pays Bonus once a user reaches Referrals confirmed referrals.
+type Milestone struct {
+	Referrals int     `bson:"referrals" json:"referrals"`
+	Bonus     float64 `bson:"bonus" json:"bonus"`
+}
+
+// Badge is earned at Referrals confirmed referrals and multiplies the
+// referral rewards its holder is paid by Multiplier.
+type Badge struct {
+	Name       string  `bson:"name" json:"name"`
+	Referrals  int     `bson:"referrals" json:"referrals"`
+	Multiplier float64 `bson:"multiplier" json:"multiplier"`
+}
+
+// parseMilestones parses a comma-separated list of referrals:bonus pairs.
+func parseMilestones(s string) ([]Milestone, error) {
+	var milestones []Milestone
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		count, bonus, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("expected referrals:bonus, got %q", part)
+		}
+
+		m := Milestone{}
+		var err error
+		if m.Referrals, err = strconv.Atoi(count); err != nil || m.Referrals <= 0 {
+			return nil, fmt.Errorf("invalid referral count %q", count)
+		}
+		if m.Bonus, err = strconv.ParseFloat(bonus, 64); err != nil || m.Bonus <= 0 {
+			return nil, fmt.Errorf("invalid bonus %q", bonus)
+		}
+		if seen[m.Referrals] {
+			return nil, fmt.Errorf("%d referrals is listed twice", m.Referrals)
+		}
+		seen[m.Referrals] = true
+		milestones = append(milestones, m)
+	}
+
+	sort.Slice(milestones, func(i, j int) bool { return milestones[i].Referrals < milestones[j].Referrals })
+	return milestones, nil
+}
+
+// parseBadges parses a comma-separated list of name:referrals:multiplier
+// triples.
+func parseBadges(s string) ([]Badge, error) {
+	var badges []Badge
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("expected name:referrals:multiplier, got %q", part)
+		}
+
+		b := Badge{Name: fields[0]}
+		var err error
+		if b.Referrals, err = strconv.Atoi(fields[1]); err != nil || b.Referrals <= 0 {
+			return nil, fmt.Errorf("invalid referral count %q", fields[1])
+		}
+		if b.Multiplier, err = strconv.ParseFloat(fields[2], 64); err != nil || b.Multiplier <= 0 {
+			return nil, fmt.Errorf("invalid multiplier %q", fields[2])
+		}
+		if seen[b.Referrals] {
+			return nil, fmt.Errorf("%d referrals is listed twice", b.Referrals)
+		}
+		seen[b.Referrals] = true
+		badges = append(badges, b)
+	}
+
+	sort.Slice(badges, func(i, j int) bool { return badges[i].Referrals < badges[j].Referrals })
+	return badges, nil
+}
+
+// badgeFor returns the badge held at referrals confirmed referrals and the
+// one after it. Either is nil if there is none.
+func badgeFor(referrals int) (current, next *Badge) {
+	badges := settings().Badges
+	for i := range badges {
+		if referrals < badges[i].Referrals {
+			return current, &badges[i]
+		}
+		current = &badges[i]
+	}
+	return current, nil
+}
+
+// badgeMultiplier is what referral rewards paid to user are multiplied by.
+func (a *app) badgeMultiplier(user *User) float64 {
+	if len(settings().Badges) == 0 {
+		return 1
+	}
+	_, confirmed := a.referralCounts(user)
+	if badge, _ := badgeFor(confirmed); badge != nil {
+		return badge.Multiplier
+	}
+	return 1
+}
+
+func progressBar(done, total int) string {
+	filled := 0
+	if total > 0 {
+		filled = done * progressBarWidth / total
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return strings.Repeat("▰", filled) + strings.Repeat("▱", progressBarWidth-filled)
+}
+
+// achievementText describes the user's badge, last milestone and progress
+// towards the next badge. It is empty when neither is configured.
+func (a *app) achievementText(user *User) string {
+	s := settings()
+	if len(s.Badges) == 0 && len(s.Milestones) == 0 {
+		return ""
+	}
+	_, confirmed := a.referralCounts(user)
+
+	var lines []string
+	if len(s.Badges) > 0 {
+		current, next := badgeFor(confirmed)
+		badge := "none yet"
+		if current != nil {
+			badge = fmt.Sprintf("%s (x%s rewards)", html.EscapeString(current.Name), strconv.FormatFloat(current.Multiplier, 'f', -1, 64))
+		}
+		lines = append(lines, "🏅 <b>Badge:</b> "+badge)
+		if next != nil {
+			lines = append(lines, fmt.Sprintf("🎯 <b>Next: %s</b> %s %d/%d",
+				html.EscapeString(next.Name), progressBar(confirmed, next.Referrals), confirmed, next.Referrals))
+		}
+	}
+
+	milestone := "none yet"
+	for _, m := range s.Milestones {
+		if confirmed >= m.Referrals {
+			milestone = fmt.Sprintf("%d referrals", m.Referrals)
+		}
+	}
+	if len(s.Milestones) > 0 {
+		lines = append(lines, "🏆 <b>Milestone:</b> "+milestone)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// payMilestoneBonuses pays the user every milestone bonus they have reached
+// and not been paid yet.
+func (a *app) payMilestoneBonuses(b *gotgbot.Bot, user *User) {
+	milestones := settings().Milestones
+	if len(milestones) == 0 {
+		return
+	}
+
+	_, confirmed := a.referralCounts(user)
+	for _, m := range milestones {
+		if confirmed < m.Referrals {
+			return
+		}
+
+		entry := Transaction{Type: TxMilestoneBonus, Reason: fmt.Sprintf("milestone of %d referrals", m.Referrals)}
+		_, err := a.store.ClaimMilestone(user.ID, m.Referrals, m.Bonus, entry)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to pay milestone %d to %d: %v", m.Referrals, user.ID, err)
+			return
+		}
+		_, _ = b.SendMessage(user.ID, fmt.Sprintf(
+			"🏆 <b>Milestone Reached!</b>\n\n"+
+				"🤝 You've made <b>%d</b> confirmed referrals.\n"+
+				"💵 You’ve earned a bonus of <b>%s</b>! 🚀",
+			m.Referrals, formatAmount(m.Bonus)), &gotgbot.SendMessageOpts{
+			ParseMode: "HTML",
+		})
+	}
+}
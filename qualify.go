@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Referral states. Rewards are only paid once a referral is confirmed.
+// Suspicious referrals wait in review until an admin decides on them.
+const (
+	ReferralPending   = "pending"
+	ReferralReview    = "review"
+	ReferralConfirmed = "confirmed"
+	ReferralRejected  = "rejected"
+)
+
+// referralCheckInterval is how often pending referrals are re-evaluated.
+const referralCheckInterval = time.Minute
+
+// Referral tracks the reward for one referee until it qualifies.
+// FraudScore and FraudSignals describe how suspicious the referral looked,
+// and Campaign names the campaign the referee signed up through, if any.
+type Referral struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	RefereeID    int64              `bson:"referee_id" json:"referee_id"`
+	RefereeName  string             `bson:"referee_name" json:"referee_name"`
+	ReferrerID   int64              `bson:"referrer_id" json:"referrer_id"`
+	Status       string             `bson:"status" json:"status"`
+	Reason       string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	FraudScore   int                `bson:"fraud_score,omitempty" json:"fraud_score,omitempty"`
+	FraudSignals []string           `bson:"fraud_signals,omitempty" json:"fraud_signals,omitempty"`
+	Campaign     string             `bson:"campaign,omitempty" json:"campaign,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	QualifiesAt  time.Time          `bson:"qualifies_at" json:"qualifies_at"`
+	SettledAt    time.Time          `bson:"settled_at,omitempty" json:"settled_at,omitempty"`
+}
+
+// referralRule decides whether a due referral may be paid. It returns a
+// non-empty reason when the referral must be rejected.
+type referralRule func(a *app, b *gotgbot.Bot, r *Referral) (string, error)
+
+// referralRules are checked in order once a referral's hold period is over.
+var referralRules = []referralRule{
+	ruleEstablishedAccount,
+	ruleStillSubscribed,
+}
+
+// ruleEstablishedAccount rejects referees whose account looks newly created.
+// Telegram doesn't expose account age, but user IDs grow over time, so IDs
+// above Settings.MaxRefereeID are treated as new.
+func ruleEstablishedAccount(_ *app, _ *gotgbot.Bot, r *Referral) (string, error) {
+	if limit := settings().MaxRefereeID; limit > 0 && r.RefereeID > limit {
+		return "the referred account is too new", nil
+	}
+	return "", nil
+}
+
+// ruleStillSubscribed rejects referees who left a force-subscribe channel
+// during the hold period.
+func ruleStillSubscribed(a *app, b *gotgbot.Bot, r *Referral) (string, error) {
+	for _, chatID := range fsubChannels() {
+		isMember, err := a.isChannelMember(b, chatID, r.RefereeID)
+		if err != nil {
+			return "", err
+		}
+		if !isMember {
+			return "the referred user left the channel", nil
+		}
+	}
+	return "", nil
+}
+
+// recordReferral stores a pending referral and settles it straight away when
+// there is no hold period.
+func (a *app) recordReferral(b *gotgbot.Bot, referee *gotgbot.User, referrerID int64, campaign string) error {
+	hold := time.Duration(settings().ReferralHoldHours) * time.Hour
+	score, signals := a.signupSignals(b, referee, referrerID)
+	now := time.Now()
+
+	r, err := a.store.CreateReferral(Referral{
+		RefereeID:    referee.Id,
+		RefereeName:  referee.FirstName,
+		ReferrerID:   referrerID,
+		Status:       ReferralPending,
+		FraudScore:   score,
+		FraudSignals: signals,
+		Campaign:     campaign,
+		CreatedAt:    now,
+		QualifiesAt:  now.Add(hold),
+	})
+	if err != nil {
+		return err
+	}
+
+	if hold == 0 {
+		return a.qualifyReferral(b, r)
+	}
+
+	_, _ = b.SendMessage(referrerID, fmt.Sprintf(
+		"⏳ <b>Referral Pending</b>\n\n"+
+			"👤 <b>%s</b> (%d) joined with your link.\n"+
+			"💵 Your reward is credited once they qualify, in about %d hours.",
+		html.EscapeString(referee.FirstName), referee.Id, settings().ReferralHoldHours), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
+
+// qualifyReferral checks r against referralRules and pays or rejects it.
+// Referrals whose fraud score reaches fraudReviewScore are held for review.
+func (a *app) qualifyReferral(b *gotgbot.Bot, r *Referral) error {
+	for _, rule := range referralRules {
+		reason, err := rule(a, b, r)
+		if err != nil {
+			return fmt.Errorf("failed to check referral of %d: %v", r.RefereeID, err)
+		}
+		if reason != "" {
+			return a.rejectReferral(b, r, reason)
+		}
+	}
+
+	score, signals := r.FraudScore, r.FraudSignals
+	if points, signal := a.inactivitySignal(r); points > 0 {
+		score += points
+		signals = append(signals, signal)
+	}
+	if score >= fraudReviewScore {
+		return a.holdForReview(b, r, score, signals)
+	}
+
+	// Settling first means a referral can only ever be paid once.
+	if err := a.store.TransitionReferral(r.ID, ReferralPending, ReferralConfirmed, ""); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+
+	a.payReferralRewards(b, &gotgbot.User{Id: r.RefereeID, FirstName: r.RefereeName}, r.ReferrerID, a.referralMultiplier(r))
+	return nil
+}
+
+func (a *app) rejectReferral(b *gotgbot.Bot, r *Referral, reason string) error {
+	if err := a.store.TransitionReferral(r.ID, ReferralPending, ReferralRejected, reason); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+
+	_, _ = b.SendMessage(r.ReferrerID, fmt.Sprintf(
+		"❌ <b>Referral Not Rewarded</b>\n\n"+
+			"👤 <b>%s</b> (%d) didn't qualify: %s.",
+		html.EscapeString(r.RefereeName), r.RefereeID, reason), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+	return nil
+}
+
+// qualifyDueReferrals settles every pending referral whose hold is over.
+func (a *app) qualifyDueReferrals(b *gotgbot.Bot) {
+	due, err := a.store.DueReferrals(time.Now())
+	if err != nil {
+		log.Printf("Failed to load due referrals: %v", err)
+		return
+	}
+
+	for i := range due {
+		if err := a.qualifyReferral(b, &due[i]); err != nil {
+			log.Printf("Failed to qualify referral: %v", err)
+		}
+	}
+}
+
+// runReferralQualifier settles due referrals every referralCheckInterval.
+func (a *app) runReferralQualifier(b *gotgbot.Bot) {
+	ticker := time.NewTicker(referralCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.qualifyDueReferrals(b)
+	}
+}
+
+// referralCounts returns how many of the user's referrals are pending and
+// confirmed. Referrals made before rewards were deferred count as confirmed.
+func (a *app) referralCounts(user *User) (pending, confirmed int) {
+	referrals, err := a.store.ReferralsByReferrer(user.ID)
+	if err != nil {
+		log.Printf("Failed to load referrals of %d: %v", user.ID, err)
+		return 0, len(user.ReferredUsers)
+	}
+
+	var rejected int
+	for _, r := range referrals {
+		switch r.Status {
+		case ReferralPending, ReferralReview:
+			pending++
+		case ReferralRejected:
+			rejected++
+		}
+	}
+
+	confirmed = len(user.ReferredUsers) - pending - rejected
+	if confirmed < 0 {
+		confirmed = 0
+	}
+	return pending, confirmed
+}
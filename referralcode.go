@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Random codes are refCodeLength characters from refCodeAlphabet, which
+// leaves out characters that are easy to misread.
+const (
+	refCodeLength   = 8
+	refCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	refCodeAttempts = 5
+)
+
+var (
+	ErrCodeTaken   = errors.New("referral code is already taken")
+	ErrCodeInvalid = errors.New("referral code must be 4-20 letters, digits or underscores, contain a letter and not start with " + campaignPrefix)
+	ErrCodeBlocked = errors.New("referral code contains a word that isn't allowed")
+
+	vanityCodePattern = regexp.MustCompile(`^[a-z0-9_]{4,20}$`)
+
+	// blockedCodeWords are offensive or misleading words vanity codes may not
+	// contain.
+	blockedCodeWords = []string{
+		"fuck", "shit", "bitch", "cunt", "dick", "cock", "pussy", "porn",
+		"nigg", "fag", "slut", "whore", "rape", "nazi",
+		"admin", "official", "support", "owner",
+	}
+)
+
+// newRefCode returns a random referral code. It always starts with a letter
+// so it can't be mistaken for a numeric user ID.
+func newRefCode() (string, error) {
+	code := make([]byte, refCodeLength)
+	for i := range code {
+		alphabet := refCodeAlphabet
+		if i == 0 {
+			alphabet = refCodeAlphabet[:strings.IndexByte(refCodeAlphabet, '2')]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// validateVanityCode normalizes code and checks it may be claimed.
+func validateVanityCode(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if !vanityCodePattern.MatchString(code) || strings.Trim(code, "0123456789_") == "" || strings.HasPrefix(code, campaignPrefix) {
+		return "", ErrCodeInvalid
+	}
+
+	squashed := strings.ReplaceAll(code, "_", "")
+	for _, word := range blockedCodeWords {
+		if strings.Contains(squashed, word) {
+			return "", ErrCodeBlocked
+		}
+	}
+	return code, nil
+}
+
+// referralCode returns the code shown in the user's referral link: their
+// vanity code if they claimed one, otherwise a random code, which is created
+// on first use. It falls back to the user ID if no code can be stored.
+func (a *app) referralCode(userID int64) string {
+	fallback := strconv.FormatInt(userID, 10)
+
+	user, err := a.store.GetUser(userID)
+	if err != nil {
+		return fallback
+	}
+	if user.VanityCode != "" {
+		return user.VanityCode
+	}
+	if user.RefCode != "" {
+		return user.RefCode
+	}
+
+	for i := 0; i < refCodeAttempts; i++ {
+		code, err := newRefCode()
+		if err != nil {
+			log.Printf("Failed to generate referral code: %v", err)
+			return fallback
+		}
+		if _, err := a.store.UserByCode(code); !errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+
+		err = a.store.SetRefCode(userID, code)
+		if errors.Is(err, ErrCodeTaken) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to save referral code of %d: %v", userID, err)
+			return fallback
+		}
+		return code
+	}
+	return fallback
+}
+
+func (a *app) referralLink(b *gotgbot.Bot, userID int64) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s", b.User.Username, a.referralCode(userID))
+}
+
+// resolveReferralCode returns the user a /start argument refers to. Numeric
+// arguments are user IDs from links made before referral codes existed.
+func (a *app) resolveReferralCode(code string) (int64, error) {
+	if id, err := strconv.ParseInt(code, 10, 64); err == nil {
+		if id <= 0 {
+			return 0, ErrCodeInvalid
+		}
+		return id, nil
+	}
+
+	user, err := a.store.UserByCode(strings.ToLower(code))
+	if err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+// codeCmd shows the user's referral link, or claims a vanity code.
+func (a *app) codeCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	args := ctx.Args()[1:]
+
+	if _, err := a.store.GetUser(user.Id); err != nil {
+		_, _ = msg.Reply(b, "❌ Please use /start first.", nil)
+		return nil
+	}
+
+	if len(args) == 0 {
+		_, _ = msg.Reply(b, fmt.Sprintf(
+			"🔗 <b>Your referral link:</b>\n%s\n\n"+
+				"✏️ Claim a custom code with <code>/code &lt;your_code&gt;</code>.",
+			a.referralLink(b, user.Id)), &gotgbot.SendMessageOpts{
+			ParseMode: "HTML",
+			LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+				IsDisabled: true,
+			},
+		})
+		return nil
+	}
+
+	code, err := validateVanityCode(args[0])
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ "+err.Error()+".", nil)
+		return nil
+	}
+
+	if owner, err := a.store.UserByCode(code); err == nil && owner.ID != user.Id {
+		_, _ = msg.Reply(b, "❌ "+ErrCodeTaken.Error()+".", nil)
+		return nil
+	} else if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		_, _ = msg.Reply(b, "❌ Failed to check the code.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+
+	err = a.store.SetVanityCode(user.Id, code)
+	if errors.Is(err, ErrCodeTaken) {
+		_, _ = msg.Reply(b, "❌ "+ErrCodeTaken.Error()+".", nil)
+		return nil
+	}
+	if err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to save the code.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+
+	_, _ = msg.Reply(b, fmt.Sprintf(
+		"✅ <b>Code claimed!</b>\n\n🔗 <b>Your referral link:</b>\n%s",
+		a.referralLink(b, user.Id)), &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+		LinkPreviewOptions: &gotgbot.LinkPreviewOptions{
+			IsDisabled: true,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// maxReferralDepth caps how far up the referrer chain rewards are paid,
+// whatever REFERRAL_TIERS says.
+const maxReferralDepth = 10
+
+// parseReferralTiers parses a comma-separated list of per-level rewards.
+func parseReferralTiers(s string) ([]float64, error) {
+	tiers, err := parseFloat64List(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiers) > maxReferralDepth {
+		return nil, fmt.Errorf("at most %d levels are supported", maxReferralDepth)
+	}
+	for _, amount := range tiers {
+		if amount < 0 {
+			return nil, fmt.Errorf("rewards can't be negative")
+		}
+	}
+	return tiers, nil
+}
+
+// payReferralRewards pays every level of newUser's referrer chain and tells
+// each referrer about it. A referrer seen twice stops the walk, so corrupt
+// data forming a cycle can't pay anyone repeatedly. Every reward is
+// multiplied by multiplier and by the referrer's badge multiplier, and the
+// direct referrer is paid any milestone bonus they reached.
+func (a *app) payReferralRewards(b *gotgbot.Bot, newUser *gotgbot.User, referrerID int64, multiplier float64) {
+	tiers := settings().ReferralTiers
+	visited := map[int64]bool{newUser.Id: true}
+	current := referrerID
+
+	for level := 1; level <= len(tiers) && level <= maxReferralDepth; level++ {
+		if current == 0 || visited[current] {
+			return
+		}
+		visited[current] = true
+
+		referrer, err := a.store.GetUser(current)
+		if err != nil {
+			log.Printf("Failed to fetch level %d referrer %d: %v", level, current, err)
+			return
+		}
+
+		amount := tiers[level-1] * multiplier * a.badgeMultiplier(referrer)
+		if amount > 0 {
+			a.payReferralReward(b, newUser, referrer.ID, level, amount)
+		}
+		if level == 1 {
+			a.payMilestoneBonuses(b, referrer)
+		}
+
+		current = referrer.Referrer
+	}
+}
+
+func (a *app) payReferralReward(b *gotgbot.Bot, newUser *gotgbot.User, referrerID int64, level int, amount float64) {
+	_, err := a.store.Credit(referrerID, amount, Transaction{
+		Type:    TxReferral,
+		ActorID: newUser.Id,
+		Level:   level,
+		Reason:  fmt.Sprintf("level %d referral of user %d", level, newUser.Id),
+	})
+	if err != nil {
+		log.Printf("Failed to pay level %d referral reward to %d: %v", level, referrerID, err)
+		return
+	}
+
+	text := fmt.Sprintf(
+		"🎉 <b>Referral Successful!</b>\n\n"+
+			"👤 You referred <b>%s</b> (%d) successfully!\n"+
+			"💵 You’ve earned <b>%s</b>! Keep sharing and earning more! 🚀",
+		html.EscapeString(newUser.FirstName), newUser.Id, formatAmount(amount))
+	if level > 1 {
+		text = fmt.Sprintf(
+			"🎉 <b>Team Referral Bonus!</b>\n\n"+
+				"👥 <b>%s</b> (%d) joined through your level %d network.\n"+
+				"💵 You’ve earned <b>%s</b>! 🚀",
+			html.EscapeString(newUser.FirstName), newUser.Id, level, formatAmount(amount))
+	}
+
+	_, _ = b.SendMessage(referrerID, text, &gotgbot.SendMessageOpts{
+		ParseMode: "HTML",
+	})
+}
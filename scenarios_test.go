@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+func TestStartReferralFlow(t *testing.T) {
+	h := newHarness(t, User{ID: 10})
+	referee := testUser(20, "Alice")
+
+	h.sendText(referee, "/start 10")
+
+	user, err := h.store.GetUser(20)
+	if err != nil {
+		t.Fatalf("referee not registered: %v", err)
+	}
+	if user.Referrer != 10 {
+		t.Fatalf("referrer = %d, want 10", user.Referrer)
+	}
+
+	referrer, _ := h.store.GetUser(10)
+	if referrer.Balance != 10 {
+		t.Fatalf("referrer balance = %.2f, want 10", referrer.Balance)
+	}
+	if len(referrer.ReferredUsers) != 1 || referrer.ReferredUsers[0] != 20 {
+		t.Fatalf("referred users = %v, want [20]", referrer.ReferredUsers)
+	}
+
+	txs, _ := h.store.Transactions(10)
+	if len(txs) != 1 || txs[0].Type != TxReferral || txs[0].ActorID != 20 {
+		t.Fatalf("ledger = %+v, want one referral entry by 20", txs)
+	}
+
+	if !strings.Contains(h.lastText(10), "Referral Successful") {
+		t.Fatalf("referrer not notified, got %q", h.lastText(10))
+	}
+	if !strings.Contains(h.lastText(20), "Welcome to the Refer & Earn Bot") {
+		t.Fatalf("referee not welcomed, got %q", h.lastText(20))
+	}
+
+	// Starting again must not pay the referrer twice.
+	h.sendText(referee, "/start 10")
+	referrer, _ = h.store.GetUser(10)
+	if referrer.Balance != 10 {
+		t.Fatalf("referrer balance after repeat /start = %.2f, want 10", referrer.Balance)
+	}
+}
+
+func TestStartRequiresChannelMembership(t *testing.T) {
+	const channel = -100500
+	h := newHarness(t)
+	FSubIds = []int64{channel}
+	user := testUser(30, "Bob")
+
+	h.sendText(user, "/start")
+
+	if _, err := h.store.GetUser(30); err == nil {
+		t.Fatal("user registered without joining the channel")
+	}
+	if !strings.Contains(h.lastText(30), "You must be a member") {
+		t.Fatalf("join prompt not sent, got %q", h.lastText(30))
+	}
+
+	h.api.setMember(channel, 30, "member")
+	h.sendText(user, "/start")
+
+	if _, err := h.store.GetUser(30); err != nil {
+		t.Fatalf("member not registered: %v", err)
+	}
+}
+
+func TestWithdrawalConversation(t *testing.T) {
+	h := newHarness(t, User{ID: 40, AccNo: 999, Balance: 50})
+	user := testUser(40, "Carol")
+
+	h.press(user, privateChat(40), userCallback("withdraw", 40))
+	h.sendText(user, "20")
+
+	got, _ := h.store.GetUser(40)
+	if got.Balance != 30 {
+		t.Fatalf("balance = %.2f, want 30", got.Balance)
+	}
+
+	logged := h.api.Calls("sendMessage")
+	var request apiCall
+	for _, c := range logged {
+		if c.Params["chat_id"] == strconv.Itoa(testLoggerID) {
+			request = c
+		}
+	}
+	if request.Method == "" {
+		t.Fatal("withdrawal request not sent to the logger")
+	}
+	confirm := buttons(t, request)["✅ Confirm Withdrawal"]
+	if confirm == "" {
+		t.Fatal("logger message has no confirm button")
+	}
+
+	// A random member of the logger chat can't approve.
+	h.press(testUser(41, "Mallory"), privateChat(testLoggerID), confirm)
+	if len(h.store.audits) != 1 || h.store.audits[0].Allowed {
+		t.Fatalf("unauthorized press not audited: %+v", h.store.audits)
+	}
+	if strings.Contains(h.lastText(40), "Withdrawal Approved") {
+		t.Fatal("unauthorized press approved the withdrawal")
+	}
+
+	h.press(testUser(testOwnerID, "Owner"), privateChat(testLoggerID), confirm)
+	if !strings.Contains(h.lastText(40), "Withdrawal Approved") {
+		t.Fatalf("user not notified of approval, got %q", h.lastText(40))
+	}
+
+	// Approving twice is rejected by the state machine.
+	before := len(h.api.Calls("sendMessage"))
+	h.press(testUser(testOwnerID, "Owner"), privateChat(testLoggerID), confirm)
+	if after := len(h.api.Calls("sendMessage")); after != before {
+		t.Fatalf("second approval sent %d more messages", after-before)
+	}
+}
+
+func TestWithdrawalCancel(t *testing.T) {
+	h := newHarness(t, User{ID: 42, AccNo: 999, Balance: 50})
+	user := testUser(42, "Dan")
+
+	h.press(user, privateChat(42), userCallback("withdraw", 42))
+	h.sendText(user, "20")
+	requests := h.api.Calls("sendMessage")
+	cancel := buttons(t, requests[len(requests)-1])["🚫 Cancel Request"]
+	if cancel == "" {
+		t.Fatal("submitted request has no cancel button")
+	}
+
+	h.press(testUser(43, "Eve"), privateChat(42), cancel)
+	if got, _ := h.store.GetUser(42); got.Balance != 30 {
+		t.Fatalf("another user cancelled the request, balance = %.2f", got.Balance)
+	}
+
+	h.press(user, privateChat(42), cancel)
+	h.press(user, privateChat(42), cancel)
+	if got, _ := h.store.GetUser(42); got.Balance != 50 {
+		t.Fatalf("balance after cancel = %.2f, want 50", got.Balance)
+	}
+	if !strings.Contains(h.lastText(testLoggerID), "cancelled") {
+		t.Fatalf("logger not told about the cancel, got %q", h.lastText(testLoggerID))
+	}
+
+	// A request no admin can see is refunded straight away.
+	h.api.failIn("sendMessage", testLoggerID)
+	h.press(user, privateChat(42), userCallback("withdraw", 42))
+	h.sendText(user, "20")
+	if got, _ := h.store.GetUser(42); got.Balance != 50 {
+		t.Fatalf("balance after a failed logger send = %.2f, want 50", got.Balance)
+	}
+	if !strings.Contains(h.lastText(42), "returned to your balance") {
+		t.Fatalf("user not told about the refund, got %q", h.lastText(42))
+	}
+}
+
+func TestWithdrawalRejectCancelled(t *testing.T) {
+	h := newHarness(t, User{ID: 44, AccNo: 999, Balance: 50})
+	user := testUser(44, "Frank")
+	owner := testUser(testOwnerID, "Owner")
+	logger := privateChat(testLoggerID)
+
+	h.press(user, privateChat(44), userCallback("withdraw", 44))
+	h.sendText(user, "20")
+	var request apiCall
+	for _, c := range h.api.Calls("sendMessage") {
+		if c.Params["chat_id"] == strconv.Itoa(testLoggerID) {
+			request = c
+		}
+	}
+	reject := buttons(t, request)["❌ Reject"]
+	if reject == "" {
+		t.Fatal("logger message has no reject button")
+	}
+
+	h.press(owner, logger, reject)
+	h.sendTextIn(owner, logger, "/cancel", nil)
+	if len(h.app.pendingRejections) != 0 {
+		t.Fatalf("cancelled rejection still pending: %+v", h.app.pendingRejections)
+	}
+
+	h.sendTextIn(owner, logger, "not a reason", nil)
+	if got, _ := h.store.GetUser(44); got.Balance != 30 {
+		t.Fatalf("cancelled rejection refunded the request, balance = %.2f", got.Balance)
+	}
+
+	// The user cancels while the admin is still writing the reason.
+	var submitted apiCall
+	for _, c := range h.api.Calls("sendMessage") {
+		if c.Params["chat_id"] == "44" {
+			submitted = c
+		}
+	}
+	h.press(owner, logger, reject)
+	h.press(user, privateChat(44), buttons(t, submitted)["🚫 Cancel Request"])
+	h.sendTextIn(owner, logger, "too late", nil)
+	last := h.store.audits[len(h.store.audits)-1]
+	if last.Action != "reject_withdrawal" || last.Allowed {
+		t.Fatalf("stale rejection not audited as denied: %+v", last)
+	}
+	if got, _ := h.store.GetUser(44); got.Balance != 50 {
+		t.Fatalf("balance = %.2f, want 50", got.Balance)
+	}
+}
+
+func TestBroadcastCopiesToAllUsers(t *testing.T) {
+	h := newHarness(t, User{ID: testOwnerID}, User{ID: 50}, User{ID: 51})
+	owner := testUser(testOwnerID, "Owner")
+
+	h.sendTextIn(owner, privateChat(testOwnerID), "/broadcast", &gotgbot.Message{MessageId: 7, Chat: privateChat(testOwnerID)})
+
+	copies := h.api.Calls("copyMessage")
+	if len(copies) != 3 {
+		t.Fatalf("copyMessage called %d times, want 3", len(copies))
+	}
+	for _, c := range copies {
+		if c.Params["message_id"] != "7" {
+			t.Fatalf("copied message %s, want 7", c.Params["message_id"])
+		}
+	}
+	if !strings.Contains(h.lastText(testOwnerID), "Broadcast successfully to 3 users") {
+		t.Fatalf("broadcast summary missing, got %q", h.lastText(testOwnerID))
+	}
+}
+
+func TestFSubCommandManagesChannels(t *testing.T) {
+	const channel = -100600
+	h := newHarness(t)
+	owner := testUser(testOwnerID, "Owner")
+	user := testUser(60, "Dave")
+
+	h.sendText(owner, "/fsub add "+strconv.Itoa(channel))
+	if channels, _ := h.store.FSubChannels(); len(channels) != 0 {
+		t.Fatalf("channel added without bot admin rights: %+v", channels)
+	}
+
+	h.api.setMember(channel, testBotID, "administrator")
+	h.sendText(owner, "/fsub add "+strconv.Itoa(channel))
+	if channels, _ := h.store.FSubChannels(); len(channels) != 1 || channels[0].ID != channel {
+		t.Fatalf("channels = %+v, want [%d]", channels, channel)
+	}
+
+	h.sendText(user, "/start")
+	if !strings.Contains(h.lastText(60), "You must be a member") {
+		t.Fatalf("runtime channel not enforced, got %q", h.lastText(60))
+	}
+
+	h.sendText(owner, "/fsub remove "+strconv.Itoa(channel))
+	h.sendText(user, "/start")
+	if _, err := h.store.GetUser(60); err != nil {
+		t.Fatalf("user not registered after channel removal: %v", err)
+	}
+}
+
+func TestFSubGuardsEveryInteraction(t *testing.T) {
+	const channel = -100700
+	h := newHarness(t, User{ID: 70, AccNo: 1, Balance: 50})
+	FSubIds = []int64{channel}
+	user := testUser(70, "Erin")
+
+	h.sendText(user, "/info")
+	if !strings.Contains(h.lastText(70), "You must be a member") {
+		t.Fatalf("/info not guarded, got %q", h.lastText(70))
+	}
+
+	h.press(user, privateChat(70), userCallback("withdraw", 70))
+	h.sendText(user, "20")
+	if got, _ := h.store.GetUser(70); got.Balance != 50 {
+		t.Fatalf("non-member withdrew, balance = %.2f", got.Balance)
+	}
+
+	h.sendText(user, "/help")
+	if !strings.Contains(h.lastText(70), "Bot Commands") {
+		t.Fatalf("/help should bypass fsub, got %q", h.lastText(70))
+	}
+
+	// Confirmed memberships are cached, so later taps skip GetChatMember.
+	h.api.setMember(channel, 70, "member")
+	h.sendText(user, "/info")
+	h.api.Reset()
+	h.sendText(user, "/info")
+	if calls := h.api.Calls("getChatMember"); len(calls) != 0 {
+		t.Fatalf("membership not cached: %d getChatMember calls", len(calls))
+	}
+}
+
+func TestLeavePolicy(t *testing.T) {
+	const channel = -100800
+	referrer := User{ID: 80}
+	referee := testUser(81, "Frank")
+
+	for _, tc := range []struct {
+		policy  string
+		balance float64
+		txType  string
+	}{
+		{LeavePolicyOff, 10, ""},
+		{LeavePolicyReverse, 0, TxReferralReversal},
+		{LeavePolicyFreeze, 0, TxReferralFreeze},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			h := newHarness(t, referrer)
+			FSubIds = []int64{channel}
+			prev := LeavePolicy
+			LeavePolicy = tc.policy
+			t.Cleanup(func() { LeavePolicy = prev })
+
+			h.api.setMember(channel, 81, "member")
+			h.sendText(referee, "/start 80")
+			h.memberUpdate(channel, referee, "member", "left")
+
+			got, _ := h.store.GetUser(80)
+			if got.Balance != tc.balance {
+				t.Fatalf("referrer balance = %.2f, want %.2f", got.Balance, tc.balance)
+			}
+			if events, _ := h.store.MembershipEvents(81); len(events) != 1 || events[0].Event != MemberLeft {
+				t.Fatalf("membership events = %+v, want one leave", events)
+			}
+			if tc.txType == "" {
+				return
+			}
+
+			txs, _ := h.store.Transactions(80)
+			if last := txs[len(txs)-1]; last.Type != tc.txType || last.Amount != -10 {
+				t.Fatalf("last ledger entry = %+v, want %s of -10", last, tc.txType)
+			}
+			if !strings.Contains(h.lastText(80), "Referral Reward") {
+				t.Fatalf("referrer not notified, got %q", h.lastText(80))
+			}
+
+			// Leaving twice never claws back twice; rejoining releases a freeze.
+			h.memberUpdate(channel, referee, "left", "member")
+			h.memberUpdate(channel, referee, "member", "left")
+			h.memberUpdate(channel, referee, "left", "member")
+			want := 0.0
+			if tc.policy == LeavePolicyFreeze {
+				want = 10
+			}
+			if got, _ := h.store.GetUser(80); got.Balance != want {
+				t.Fatalf("balance after rejoin = %.2f, want %.2f", got.Balance, want)
+			}
+		})
+	}
+}
+
+func TestLeavePolicyAcrossChannels(t *testing.T) {
+	channels := []int64{-100810, -100811}
+	h := newHarness(t, User{ID: 82, Balance: 5})
+	FSubIds = channels
+	prev := LeavePolicy
+	LeavePolicy = LeavePolicyFreeze
+	t.Cleanup(func() { LeavePolicy = prev })
+	referee := testUser(83, "Gina")
+
+	for _, id := range channels {
+		h.api.setMember(id, 83, "member")
+	}
+	h.sendText(referee, "/start 82")
+
+	// Leaving every channel at once freezes the reward only once.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = h.app.applyLeavePolicy(h.bot, 83)
+		}()
+	}
+	wg.Wait()
+	if got, _ := h.store.GetUser(82); got.Balance != 5 {
+		t.Fatalf("balance after concurrent leaves = %.2f, want 5", got.Balance)
+	}
+
+	for _, id := range channels {
+		h.api.setMember(id, 83, "left")
+		h.memberUpdate(id, referee, "member", "left")
+	}
+	if got, _ := h.store.GetUser(82); got.Balance != 5 {
+		t.Fatalf("balance after leaving both channels = %.2f, want 5", got.Balance)
+	}
+
+	// Rejoining one channel while still outside the other releases nothing.
+	h.api.setMember(channels[0], 83, "member")
+	h.memberUpdate(channels[0], referee, "left", "member")
+	if got, _ := h.store.GetUser(82); got.Balance != 5 {
+		t.Fatalf("reward released with a channel still left, balance = %.2f", got.Balance)
+	}
+
+	h.api.setMember(channels[1], 83, "member")
+	h.memberUpdate(channels[1], referee, "left", "member")
+	h.memberUpdate(channels[1], referee, "left", "member")
+	if got, _ := h.store.GetUser(82); got.Balance != 15 {
+		t.Fatalf("balance after rejoining = %.2f, want 15", got.Balance)
+	}
+}
+
+func TestReferralInviteLinkAttribution(t *testing.T) {
+	const channel = -100900
+	h := newHarness(t, User{ID: 90})
+	FSubIds = []int64{channel}
+	referee := testUser(91, "Grace")
+
+	h.sendText(referee, "/start 90")
+	prompt := h.api.Calls("sendMessage")
+	var link string
+	for _, row := range decodeMarkup(t, prompt[len(prompt)-1]).InlineKeyboard {
+		if row[0].Url != "" && strings.HasPrefix(row[0].Text, "Jᴏɪɴ") {
+			link = row[0].Url
+		}
+	}
+
+	invite, err := h.store.FindInviteLink(channel, 90, "", false)
+	if err != nil || invite.Link != link {
+		t.Fatalf("prompt link %q, stored %+v (%v)", link, invite, err)
+	}
+
+	// A second referee reuses the same link.
+	h.sendText(testUser(92, "Heidi"), "/start 90")
+	if calls := h.api.Calls("createChatInviteLink"); len(calls) != 1 {
+		t.Fatalf("createChatInviteLink called %d times, want 1", len(calls))
+	}
+
+	h.memberUpdateVia(channel, referee, "left", "member", link)
+	h.memberUpdate(channel, referee, "member", "left")
+	h.memberUpdateVia(channel, referee, "left", "member", link)
+
+	if joins := h.store.invites[link].Joins; joins != 1 {
+		t.Fatalf("joins = %d, want 1", joins)
+	}
+	if events, _ := h.store.MembershipEvents(91); events[0].ReferrerID != 90 {
+		t.Fatalf("join not attributed: %+v", events[0])
+	}
+
+	h.api.setMember(channel, 90, "member")
+	h.sendText(testUser(90, "Ivan"), "/info")
+	if !strings.Contains(h.lastText(90), "Channel Joins via Your Link:</b> 1") {
+		t.Fatalf("join count not shown, got %q", h.lastText(90))
+	}
+
+	// Campaign links get the campaign's own invite link.
+	_ = h.store.SaveCampaign(Campaign{Code: "spring", PartnerID: 90, StartsAt: time.Now().Add(-time.Hour)})
+	h.sendText(testUser(93, "Judy"), "/start c_spring")
+	invite, err = h.store.FindInviteLink(channel, 90, "spring", false)
+	if err != nil || invite.Name != "campaign-spring" {
+		t.Fatalf("campaign invite link not created: %+v (%v)", invite, err)
+	}
+}
+
+func TestJoinRequestMode(t *testing.T) {
+	const channel = -101000
+	h := newHarness(t)
+	FSubIds = []int64{channel}
+	JoinRequestLinks, AcceptPendingRequests = true, true
+	user := testUser(100, "Judy")
+
+	h.sendText(user, "/start")
+	links := h.api.Calls("createChatInviteLink")
+	if len(links) != 1 || links[0].Params["creates_join_request"] != "true" {
+		t.Fatalf("join prompt should use a join-request link, got %+v", links)
+	}
+	if _, err := h.store.GetUser(100); err == nil {
+		t.Fatal("user registered before requesting to join")
+	}
+
+	h.joinRequest(channel, user)
+	h.sendText(user, "/start")
+	if _, err := h.store.GetUser(100); err != nil {
+		t.Fatalf("pending join request did not satisfy fsub: %v", err)
+	}
+	if calls := h.api.Calls("approveChatJoinRequest"); len(calls) != 0 {
+		t.Fatalf("request approved without FSUB_AUTO_APPROVE: %+v", calls)
+	}
+
+	AutoApproveRequests = true
+	h.joinRequest(channel, testUser(101, "Ken"))
+	if calls := h.api.Calls("approveChatJoinRequest"); len(calls) != 1 || calls[0].Params["user_id"] != "101" {
+		t.Fatalf("approveChatJoinRequest calls = %+v, want one for 101", calls)
+	}
+}
+
+func TestInviteLinkFallbackAndRefresh(t *testing.T) {
+	const channel = -101100
+	h := newHarness(t)
+	FSubIds = []int64{channel}
+	h.api.setInviteLink(channel, "")
+
+	h.sendText(testUser(110, "Liam"), "/start")
+	if !strings.Contains(h.api.Calls("sendMessage")[0].Params["reply_markup"], "exported101100") {
+		t.Fatal("empty primary link did not fall back to exportChatInviteLink")
+	}
+
+	// Cached links are reused until an owner refreshes them.
+	h.api.fail("exportChatInviteLink")
+	h.sendText(testUser(111, "Mia"), "/start")
+	if calls := h.api.Calls("exportChatInviteLink"); len(calls) != 1 {
+		t.Fatalf("exportChatInviteLink called %d times, want 1", len(calls))
+	}
+
+	h.sendText(testUser(testOwnerID, "Owner"), "/fsub refresh")
+	h.sendText(testUser(112, "Noah"), "/start")
+	if !strings.Contains(h.lastText(testLoggerID), "Invite link unavailable") {
+		t.Fatalf("failure not reported to the logger, got %q", h.lastText(testLoggerID))
+	}
+}
+
+func TestFSubChecksChannelsInOnePass(t *testing.T) {
+	channels := []int64{-101201, -101202, -101203, -101204}
+	h := newHarness(t)
+	FSubIds = channels
+	h.api.setMember(channels[1], 120, "member")
+	user := testUser(120, "Olivia")
+
+	h.api.hold("getChatMember", len(channels))
+	h.sendText(user, "/start")
+	if calls := h.api.Calls("getChatMember"); len(calls) != len(channels) {
+		t.Fatalf("getChatMember called %d times, want %d", len(calls), len(channels))
+	}
+	if peak := h.api.peakInFlight("getChatMember"); peak != len(channels) {
+		t.Fatalf("%d of %d channel checks ran at once", peak, len(channels))
+	}
+
+	prompt := decodeMarkup(t, h.api.Calls("sendMessage")[0])
+	if len(prompt.InlineKeyboard) != 3 {
+		t.Fatalf("prompt has %d join buttons, want 3", len(prompt.InlineKeyboard))
+	}
+	for i, id := range []int64{channels[0], channels[2], channels[3]} {
+		if !strings.HasSuffix(prompt.InlineKeyboard[i][0].Url, strconv.FormatInt(-id, 10)) {
+			t.Fatalf("button %d links to %s, want channel %d", i, prompt.InlineKeyboard[i][0].Url, id)
+		}
+	}
+}
+
+func TestMultiLevelReferralRewards(t *testing.T) {
+	h := newHarness(t,
+		User{ID: 130},
+		User{ID: 131, Referrer: 130},
+		User{ID: 132, Referrer: 131},
+		// 140 and 141 refer each other, which must not loop.
+		User{ID: 140, Referrer: 141},
+		User{ID: 141, Referrer: 140},
+	)
+	h.sendText(testUser(testOwnerID, "Owner"), "/settings tiers 10,2,0.5")
+
+	h.sendText(testUser(133, "Pat <3"), "/start 132")
+	for id, want := range map[int64]float64{132: 10, 131: 2, 130: 0.5} {
+		txs, _ := h.store.Transactions(id)
+		if len(txs) != 1 || txs[0].Amount != want || txs[0].ActorID != 133 {
+			t.Fatalf("ledger of %d = %+v, want one %.2f reward", id, txs, want)
+		}
+		if level := int(133 - id); txs[0].Level != level {
+			t.Fatalf("reward to %d recorded level %d, want %d", id, txs[0].Level, level)
+		}
+	}
+	if !strings.Contains(h.lastText(130), "level 3 network") {
+		t.Fatalf("level 3 referrer not notified, got %q", h.lastText(130))
+	}
+	if !strings.Contains(h.lastText(132), "Pat &lt;3") {
+		t.Fatalf("referee name not escaped, got %q", h.lastText(132))
+	}
+
+	h.sendText(testUser(142, "Quinn"), "/start 140")
+	if u, _ := h.store.GetUser(140); u.Balance != 10 {
+		t.Fatalf("balance of 140 = %.2f, want 10", u.Balance)
+	}
+	if u, _ := h.store.GetUser(141); u.Balance != 2 {
+		t.Fatalf("balance of 141 = %.2f, want 2", u.Balance)
+	}
+}
+
+func TestSettingsDriveRewardsAndDisplay(t *testing.T) {
+	h := newHarness(t, User{ID: testOwnerID}, User{ID: 150})
+	owner := testUser(testOwnerID, "Owner")
+
+	h.sendText(owner, "/settings tiers 25")
+	h.sendText(owner, "/settings token coins")
+	h.sendText(owner, "/settings rate 0.1 usd")
+	if saved, err := h.store.GetSettings(); err != nil || saved.TokenName != "coins" || saved.FiatCurrency != "USD" {
+		t.Fatalf("settings not stored: %+v (%v)", saved, err)
+	}
+
+	h.sendText(testUser(151, "Rita"), "/start 150")
+	if !strings.Contains(h.lastText(150), "25.00 coins") {
+		t.Fatalf("reward message not rendered from settings, got %q", h.lastText(150))
+	}
+
+	h.sendText(testUser(150, "Sam"), "/info")
+	info := h.lastText(150)
+	for _, want := range []string{"Per refer: 25.00 coins (≈ 2.50 USD)", "Account Balance:</b> 25.00 coins (≈ 2.50 USD)"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("/info missing %q, got %q", want, info)
+		}
+	}
+
+	h.sendText(testUser(150, "Sam"), "/settings token free")
+	if saved, _ := h.store.GetSettings(); saved.TokenName != "coins" {
+		t.Fatal("non-owner changed settings")
+	}
+
+	// Names that would break HTML messages are refused.
+	h.sendText(owner, "/settings token <Gold>")
+	h.sendText(owner, "/settings rate 0.1 R&D")
+	if saved, _ := h.store.GetSettings(); saved.TokenName != "coins" || saved.FiatCurrency != "USD" {
+		t.Fatalf("HTML special characters accepted: %+v", saved)
+	}
+}
+
+func TestDeferredReferralRewards(t *testing.T) {
+	const channel = -101600
+	h := newHarness(t, User{ID: 160})
+	FSubIds = []int64{channel}
+	h.sendText(testUser(testOwnerID, "Owner"), "/settings hold 24")
+	h.sendText(testUser(testOwnerID, "Owner"), "/settings maxid 1000")
+
+	for _, id := range []int64{161, 162, 5000} {
+		h.api.setMember(channel, id, "member")
+		h.sendText(testUser(id, "Referee"), "/start 160")
+	}
+	if u, _ := h.store.GetUser(160); u.Balance != 0 {
+		t.Fatalf("referrer paid before qualification: %.2f", u.Balance)
+	}
+	if !strings.Contains(h.lastText(160), "Referral Pending") {
+		t.Fatalf("referrer not told about the pending reward, got %q", h.lastText(160))
+	}
+
+	h.api.setMember(channel, 160, "member")
+	h.sendText(testUser(160, "Tom"), "/info")
+	if !strings.Contains(h.lastText(160), "✅ 0 confirmed, ⏳ 3 pending") {
+		t.Fatalf("/info doesn't show pending referrals, got %q", h.lastText(160))
+	}
+
+	// Nothing is due until the hold is over.
+	h.app.qualifyDueReferrals(h.bot)
+	if u, _ := h.store.GetUser(160); u.Balance != 0 {
+		t.Fatalf("referrer paid during the hold: %.2f", u.Balance)
+	}
+
+	for i := range h.store.referrals {
+		h.store.referrals[i].QualifiesAt = time.Now().Add(-time.Minute)
+	}
+	h.api.setMember(channel, 162, "left")
+	memberCacheMutex.Lock()
+	memberCache = make(map[memberKey]time.Time)
+	memberCacheMutex.Unlock()
+
+	h.app.qualifyDueReferrals(h.bot)
+	h.app.qualifyDueReferrals(h.bot)
+
+	if u, _ := h.store.GetUser(160); u.Balance != 10 {
+		t.Fatalf("referrer balance = %.2f, want 10 for the one qualifying referee", u.Balance)
+	}
+	statuses := map[int64]string{}
+	for _, r := range h.store.referrals {
+		statuses[r.RefereeID] = r.Status
+	}
+	want := map[int64]string{161: ReferralConfirmed, 162: ReferralRejected, 5000: ReferralRejected}
+	for id, status := range want {
+		if statuses[id] != status {
+			t.Fatalf("referral of %d is %q, want %q", id, statuses[id], status)
+		}
+	}
+
+	h.sendText(testUser(160, "Tom"), "/info")
+	if !strings.Contains(h.lastText(160), "✅ 1 confirmed, ⏳ 0 pending") {
+		t.Fatalf("/info counts not updated, got %q", h.lastText(160))
+	}
+}
+
+func TestFraudReviewQueue(t *testing.T) {
+	h := newHarness(t, User{ID: 170})
+	owner := testUser(testOwnerID, "Owner")
+
+	h.sendText(testUser(172, "Vic"), "/start 172")
+	if !strings.Contains(h.lastText(172), "refer themselves") {
+		t.Fatalf("self referral not rejected, got %q", h.lastText(172))
+	}
+
+	// No username, language or photo scores high enough to be held.
+	suspect := gotgbot.User{Id: 171, FirstName: "Farm"}
+	h.api.setPhotos(171, 0)
+	h.sendText(suspect, "/start 170")
+	if u, _ := h.store.GetUser(170); u.Balance != 0 {
+		t.Fatalf("suspicious referral paid: %.2f", u.Balance)
+	}
+	if len(h.store.referrals) != 1 || h.store.referrals[0].Status != ReferralReview || h.store.referrals[0].FraudScore != 55 {
+		t.Fatalf("referral not held for review: %+v", h.store.referrals)
+	}
+	if !strings.Contains(h.lastText(170), "Referral Under Review") {
+		t.Fatalf("referrer not told about the review, got %q", h.lastText(170))
+	}
+
+	h.sendText(owner, "/review")
+	queue := h.api.Calls("sendMessage")
+	approve := buttons(t, queue[len(queue)-1])["✅ Approve"]
+	if !strings.Contains(h.lastText(testOwnerID), "1 referral(s) waiting") || approve == "" {
+		t.Fatalf("/review doesn't show the held referral, got %q", h.lastText(testOwnerID))
+	}
+
+	h.press(testUser(41, "Mallory"), privateChat(testLoggerID), approve)
+	if u, _ := h.store.GetUser(170); u.Balance != 0 {
+		t.Fatal("unauthorized press approved the referral")
+	}
+
+	h.press(owner, privateChat(testLoggerID), approve)
+	h.press(owner, privateChat(testLoggerID), approve)
+	if u, _ := h.store.GetUser(170); u.Balance != 10 {
+		t.Fatalf("referrer balance = %.2f after approval, want 10", u.Balance)
+	}
+
+	h.sendText(owner, "/review")
+	if !strings.Contains(h.lastText(testOwnerID), "No referrals") {
+		t.Fatalf("review queue not emptied, got %q", h.lastText(testOwnerID))
+	}
+}
+
+func TestCaptchaBeforeRegistration(t *testing.T) {
+	h := newHarness(t, User{ID: 180})
+	h.sendText(testUser(testOwnerID, "Owner"), "/settings captcha on")
+
+	// answer presses the right or a wrong option of the user's latest captcha.
+	answer := func(user gotgbot.User, correct bool) string {
+		t.Helper()
+		pendingCaptchasMu.Lock()
+		want := strconv.Itoa(pendingCaptchas[user.Id].answer)
+		pendingCaptchasMu.Unlock()
+
+		var prompt apiCall
+		for _, c := range h.api.Calls("sendMessage") {
+			if c.Params["chat_id"] == strconv.FormatInt(user.Id, 10) {
+				prompt = c
+			}
+		}
+		for text, data := range buttons(t, prompt) {
+			if (text == want) == correct {
+				h.press(user, privateChat(user.Id), data)
+				return data
+			}
+		}
+		t.Fatal("no captcha buttons sent")
+		return ""
+	}
+
+	referee := testUser(181, "Walt")
+	h.sendText(referee, "/start 180")
+	if _, err := h.store.GetUser(181); err == nil {
+		t.Fatal("user registered before solving the captcha")
+	}
+	if !strings.Contains(h.lastText(181), "Quick check") {
+		t.Fatalf("captcha not sent, got %q", h.lastText(181))
+	}
+
+	stale := answer(referee, false)
+	if f, _ := h.store.CaptchaFailures(181); f == nil || f.Count != 1 {
+		t.Fatalf("captcha failure not tracked: %+v", f)
+	}
+	h.press(referee, privateChat(181), stale)
+	if _, err := h.store.GetUser(181); err == nil {
+		t.Fatal("old captcha buttons still work")
+	}
+
+	answer(referee, true)
+	if u, err := h.store.GetUser(181); err != nil || u.Referrer != 180 {
+		t.Fatalf("user not registered with the referral after the captcha: %+v (%v)", u, err)
+	}
+	if u, _ := h.store.GetUser(180); u.Balance != 10 {
+		t.Fatalf("referrer balance = %.2f, want 10", u.Balance)
+	}
+
+	bot := testUser(182, "Xena")
+	h.sendText(bot, "/start 180")
+	for i := 0; i < maxCaptchaFailures; i++ {
+		answer(bot, false)
+	}
+	edits := h.api.Calls("editMessageText")
+	if last := edits[len(edits)-1].Params["text"]; !strings.Contains(last, "Too many wrong answers") {
+		t.Fatalf("repeated failures not stopped, got %q", last)
+	}
+	h.sendText(bot, "/start 180")
+	if !strings.Contains(h.lastText(182), "Too many wrong captcha answers") {
+		t.Fatalf("locked user got another captcha, got %q", h.lastText(182))
+	}
+	if _, err := h.store.GetUser(182); err == nil {
+		t.Fatal("user registered without solving the captcha")
+	}
+}
+
+func TestReferralCodes(t *testing.T) {
+	h := newHarness(t, User{ID: 190}, User{ID: 192})
+	owner := testUser(190, "Yara")
+
+	h.sendText(owner, "/code")
+	u, _ := h.store.GetUser(190)
+	if len(u.RefCode) != refCodeLength || !strings.Contains(h.lastText(190), "?start="+u.RefCode) {
+		t.Fatalf("random code not shown: %q (code %q)", h.lastText(190), u.RefCode)
+	}
+
+	h.sendText(testUser(191, "Zed"), "/start "+u.RefCode)
+	if got, _ := h.store.GetUser(191); got == nil || got.Referrer != 190 {
+		t.Fatalf("random code not resolved: %+v", got)
+	}
+
+	for code, want := range map[string]string{
+		"fuck_you": "isn't allowed",
+		"12345":    "must be 4-20",
+		"a b":      "must be 4-20",
+	} {
+		h.sendText(owner, "/code "+code)
+		if !strings.Contains(h.lastText(190), want) {
+			t.Fatalf("/code %s: got %q, want %q", code, h.lastText(190), want)
+		}
+	}
+
+	h.sendText(owner, "/code Yara_Ref")
+	if u, _ := h.store.GetUser(190); u.VanityCode != "yara_ref" {
+		t.Fatalf("vanity code = %q, want yara_ref", u.VanityCode)
+	}
+	h.sendText(testUser(192, "Abe"), "/code yara_ref")
+	if !strings.Contains(h.lastText(192), "already taken") {
+		t.Fatalf("duplicate vanity code accepted, got %q", h.lastText(192))
+	}
+
+	h.sendText(testUser(193, "Bea"), "/start YARA_REF")
+	h.sendText(testUser(194, "Cal"), "/start 190")
+	for _, id := range []int64{193, 194} {
+		if got, _ := h.store.GetUser(id); got == nil || got.Referrer != 190 {
+			t.Fatalf("user %d not referred by 190: %+v", id, got)
+		}
+	}
+}
+
+func TestReferralCodeInviteLink(t *testing.T) {
+	const channel = -101900
+	h := newHarness(t, User{ID: 195, VanityCode: "dee_ref"})
+	FSubIds = []int64{channel}
+	referee := testUser(196, "Eva")
+
+	h.sendText(referee, "/start dee_ref")
+	invite, err := h.store.FindInviteLink(channel, 195, "", false)
+	if err != nil {
+		t.Fatalf("no invite link created for the code's owner: %v", err)
+	}
+	prompt := h.api.Calls("sendMessage")
+	if link := decodeMarkup(t, prompt[len(prompt)-1]).InlineKeyboard[0][0].Url; link != invite.Link {
+		t.Fatalf("prompt links to %q, want %q", link, invite.Link)
+	}
+
+	h.memberUpdateVia(channel, referee, "left", "member", invite.Link)
+	h.api.setMember(channel, 196, "member")
+	h.sendText(referee, "/start dee_ref")
+	if events, _ := h.store.MembershipEvents(196); len(events) == 0 || events[0].ReferrerID != 195 {
+		t.Fatalf("join not attributed to 195: %+v", events)
+	}
+	if got, _ := h.store.GetUser(196); got == nil || got.Referrer != 195 {
+		t.Fatalf("referee not referred by 195: %+v", got)
+	}
+}
+
+func TestCampaigns(t *testing.T) {
+	h := newHarness(t, User{ID: 200})
+	owner := testUser(testOwnerID, "Owner")
+
+	h.sendText(testUser(200, "Dora"), "/campaign add promo")
+	if !strings.Contains(h.lastText(200), "not authorized") {
+		t.Fatalf("non-owner created a campaign, got %q", h.lastText(200))
+	}
+
+	h.sendText(owner, "/campaign add Promo bonus=5 x=2 partner=200 cap=1 days=3 name=Launch_Week")
+	c, err := h.store.GetCampaign("promo")
+	if err != nil || c.Bonus != 5 || c.Multiplier != 2 || c.PartnerID != 200 || c.MaxSignups != 1 {
+		t.Fatalf("campaign not saved: %+v (%v)", c, err)
+	}
+	if !strings.Contains(h.lastText(testOwnerID), "?start=c_promo") {
+		t.Fatalf("campaign link not shown, got %q", h.lastText(testOwnerID))
+	}
+
+	h.sendText(testUser(201, "Eli"), "/start c_promo")
+	if u, _ := h.store.GetUser(201); u == nil || u.Referrer != 200 || u.Balance != 5 {
+		t.Fatalf("campaign signup not referred or paid: %+v", u)
+	}
+	if u, _ := h.store.GetUser(200); u.Balance != 20 {
+		t.Fatalf("partner balance = %.2f, want the doubled reward of 20", u.Balance)
+	}
+
+	// The cap is reached, so the next signup registers without the campaign.
+	h.sendText(testUser(202, "Fay"), "/start C_PROMO")
+	if u, _ := h.store.GetUser(202); u == nil || u.Referrer != 0 || u.Balance != 0 {
+		t.Fatalf("signup past the cap used the campaign: %+v", u)
+	}
+
+	h.sendText(owner, "/campaign stats promo")
+	if text := h.lastText(testOwnerID); !strings.Contains(text, "Signups:</b> 1 / 1") || !strings.Contains(text, "full") {
+		t.Fatalf("stats not shown, got %q", text)
+	}
+
+	h.sendText(owner, "/campaign add open")
+	h.sendText(owner, "/campaign end open")
+	if !strings.Contains(h.lastText(testOwnerID), "ended") {
+		t.Fatalf("campaign not ended, got %q", h.lastText(testOwnerID))
+	}
+	h.sendText(testUser(203, "Gus"), "/start c_open")
+	if c, _ := h.store.GetCampaign("open"); c.Signups != 0 {
+		t.Fatalf("ended campaign accepted a signup: %+v", c)
+	}
+	if u, _ := h.store.GetUser(203); u == nil {
+		t.Fatal("user not registered through an ended campaign")
+	}
+
+	h.sendText(testUser(200, "Dora"), "/code c_dora")
+	if !strings.Contains(h.lastText(200), "must be 4-20") {
+		t.Fatalf("campaign prefix accepted as a vanity code, got %q", h.lastText(200))
+	}
+}
+
+func TestMilestonesAndBadges(t *testing.T) {
+	h := newHarness(t, User{ID: 210})
+	owner := testUser(testOwnerID, "Owner")
+	referrer := testUser(210, "Hal")
+
+	h.sendText(owner, "/settings milestones 2:25")
+	h.sendText(owner, "/settings badges Silver:4:2, Bronze:2:1.5")
+	if s := settings(); len(s.Badges) != 2 || s.Badges[0].Name != "Bronze" || len(s.Milestones) != 1 {
+		t.Fatalf("settings not saved: %+v", s)
+	}
+
+	h.sendText(testUser(211, "Ivy"), "/start 210")
+	if u, _ := h.store.GetUser(210); u.Balance != 10 {
+		t.Fatalf("balance after the first referral = %.2f, want 10", u.Balance)
+	}
+
+	// The second referral earns Bronze, so it pays 1.5x plus the milestone.
+	h.sendText(testUser(212, "Jon"), "/start 210")
+	if u, _ := h.store.GetUser(210); u.Balance != 50 {
+		t.Fatalf("balance after reaching Bronze = %.2f, want 10 + 15 + 25", u.Balance)
+	}
+	if !strings.Contains(h.lastText(210), "Milestone Reached") {
+		t.Fatalf("referrer not told about the milestone, got %q", h.lastText(210))
+	}
+
+	// The milestone is only paid once, even if it is checked again.
+	u, _ := h.store.GetUser(210)
+	h.app.payMilestoneBonuses(h.bot, u)
+	if u, _ := h.store.GetUser(210); u.Balance != 50 {
+		t.Fatalf("milestone paid twice: %.2f", u.Balance)
+	}
+
+	h.sendText(referrer, "/info")
+	info := h.lastText(210)
+	for _, want := range []string{"Badge:</b> Bronze (x1.5 rewards)", "Next: Silver</b> ▰▰▰▰▰▱▱▱▱▱ 2/4", "Milestone:</b> 2 referrals"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("/info missing %q, got %q", want, info)
+		}
+	}
+
+	h.press(referrer, privateChat(210), userCallback("wallet", 210))
+	edits := h.api.Calls("editMessageText")
+	if last := edits[len(edits)-1].Params["text"]; !strings.Contains(last, "Badge:</b> Bronze") {
+		t.Fatalf("wallet doesn't show the badge, got %q", last)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	h := newHarness(t, User{ID: 220}, User{ID: 1230}, User{ID: 240})
+	for id, referrer := range map[int64]string{221: "220", 222: "220", 223: "1230"} {
+		h.sendText(testUser(id, "Referee"), "/start "+referrer)
+	}
+	// A referral from last month only counts towards the all-time ranking.
+	h.sendText(testUser(224, "Referee"), "/start 1230")
+	h.sendText(testUser(225, "Referee"), "/start 1230")
+	for i := range h.store.referrals {
+		if r := &h.store.referrals[i]; r.RefereeID >= 224 {
+			r.SettledAt = periodStart(PeriodMonth, time.Now()).Add(-time.Hour)
+		}
+	}
+
+	h.sendText(testUser(1230, "Kim"), "/top daily")
+	daily := h.lastText(1230)
+	if !strings.Contains(daily, "🥇 <code>220</code> · 2") || !strings.Contains(daily, "Your Rank:</b> #2 with 1") {
+		t.Fatalf("daily leaderboard wrong, got %q", daily)
+	}
+
+	h.sendText(testUser(1230, "Kim"), "/top all")
+	if all := h.lastText(1230); !strings.Contains(all, "🥇 <code>1230</code> (you) · 3") {
+		t.Fatalf("all-time leaderboard wrong, got %q", all)
+	}
+
+	h.press(testUser(240, "Lou"), privateChat(240), userCallback("top", 240))
+	edits := h.api.Calls("editMessageText")
+	if last := edits[len(edits)-1].Params["text"]; !strings.Contains(last, "This Week") || !strings.Contains(last, "unranked") {
+		t.Fatalf("leaderboard button wrong, got %q", last)
+	}
+
+	h.sendText(testUser(220, "Max"), "/top hide")
+	h.sendText(testUser(220, "Max"), "/top daily")
+	if text := h.lastText(220); strings.Contains(text, "<code>220</code>") || !strings.Contains(text, "hidden from the leaderboard") {
+		t.Fatalf("hidden user still ranked, got %q", text)
+	}
+	h.sendText(testUser(1230, "Kim"), "/top daily")
+	if !strings.Contains(h.lastText(1230), "🥇 <code>1230</code> (you) · 1") {
+		t.Fatalf("ranks not recomputed after opt-out, got %q", h.lastText(1230))
+	}
+}
+
+func TestLeaderboardRanksHeldReferralsWhenConfirmed(t *testing.T) {
+	h := newHarness(t, User{ID: 250})
+	h.sendText(testUser(testOwnerID, "Owner"), "/settings hold 48")
+	h.sendText(testUser(251, "Referee"), "/start 250")
+
+	// The referral was made two days ago and its hold is over now.
+	for i := range h.store.referrals {
+		h.store.referrals[i].CreatedAt = time.Now().Add(-48 * time.Hour)
+		h.store.referrals[i].QualifiesAt = time.Now().Add(-time.Minute)
+	}
+	h.app.qualifyDueReferrals(h.bot)
+	resetLeaderboardCache()
+
+	h.sendText(testUser(250, "Ned"), "/top daily")
+	if !strings.Contains(h.lastText(250), "🥇 <code>250</code> (you) · 1") {
+		t.Fatalf("referral confirmed today not ranked today, got %q", h.lastText(250))
+	}
+	h.sendText(testUser(250, "Ned"), "/top all")
+	if !strings.Contains(h.lastText(250), "since referral tracking began") {
+		t.Fatalf("all-time caveat not shown, got %q", h.lastText(250))
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Settings are the reward and display options the owner can change at
+// runtime with /settings. They are stored as a single document.
+//
+// ReferralTiers holds the reward per level: index 0 is paid to the direct
+// referrer, index 1 to their referrer, and so on. FiatRate is the value of
+// one token in FiatCurrency. Referral rewards are held for ReferralHoldHours
+// before they are paid, and referees with an ID above MaxRefereeID (when
+// set) are treated as new accounts and not rewarded. With Captcha set, new
+// users must solve a captcha before they are registered. Milestones and
+// Badges are kept sorted by their referral count.
+type Settings struct {
+	ReferralTiers     []float64   `bson:"referral_tiers" json:"referral_tiers"`
+	TokenName         string      `bson:"token_name" json:"token_name"`
+	FiatRate          float64     `bson:"fiat_rate" json:"fiat_rate"`
+	FiatCurrency      string      `bson:"fiat_currency" json:"fiat_currency"`
+	ReferralHoldHours int         `bson:"referral_hold_hours" json:"referral_hold_hours"`
+	MaxRefereeID      int64       `bson:"max_referee_id,omitempty" json:"max_referee_id,omitempty"`
+	Captcha           bool        `bson:"captcha,omitempty" json:"captcha,omitempty"`
+	Milestones        []Milestone `bson:"milestones,omitempty" json:"milestones,omitempty"`
+	Badges            []Badge     `bson:"badges,omitempty" json:"badges,omitempty"`
+	UpdatedBy         int64       `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt         time.Time   `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+// defaultSettings are used until the owner saves settings of their own.
+// REFERRAL_TIERS seeds the tiers.
+var defaultSettings = Settings{
+	ReferralTiers: []float64{10},
+	TokenName:     "tokens",
+	FiatRate:      0.05,
+	FiatCurrency:  "INR",
+}
+
+var (
+	currentSettings = defaultSettings
+	settingsMutex   sync.RWMutex
+)
+
+// settings returns a copy of the settings in effect.
+func settings() Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	s := currentSettings
+	s.ReferralTiers = append([]float64(nil), s.ReferralTiers...)
+	s.Milestones = append([]Milestone(nil), s.Milestones...)
+	s.Badges = append([]Badge(nil), s.Badges...)
+	return s
+}
+
+func setSettings(s Settings) {
+	settingsMutex.Lock()
+	currentSettings = s
+	settingsMutex.Unlock()
+}
+
+// loadSettings reads the stored settings, falling back to defaultSettings.
+func (a *app) loadSettings() error {
+	s, err := a.store.GetSettings()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		setSettings(defaultSettings)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	setSettings(*s)
+	return nil
+}
+
+// htmlSpecialChars can't appear in the token name or currency, which are
+// shown unescaped in HTML messages.
+const htmlSpecialChars = "<>&"
+
+// formatAmount renders a token amount with the configured token name.
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f %s", amount, settings().TokenName)
+}
+
+// formatFiat renders the fiat value of a token amount.
+func formatFiat(amount float64) string {
+	s := settings()
+	return fmt.Sprintf("%.2f %s", amount*s.FiatRate, s.FiatCurrency)
+}
+
+// formatAmountFiat renders a token amount followed by its fiat value.
+func formatAmountFiat(amount float64) string {
+	if settings().FiatRate <= 0 {
+		return formatAmount(amount)
+	}
+	return fmt.Sprintf("%s (≈ %s)", formatAmount(amount), formatFiat(amount))
+}
+
+// directReward is the reward paid to a direct referrer.
+func directReward() float64 {
+	tiers := settings().ReferralTiers
+	if len(tiers) == 0 {
+		return 0
+	}
+	return tiers[0]
+}
+
+func settingsText(s Settings) string {
+	tiers := make([]string, len(s.ReferralTiers))
+	for i, amount := range s.ReferralTiers {
+		tiers[i] = fmt.Sprintf("L%d: %s", i+1, strconv.FormatFloat(amount, 'f', -1, 64))
+	}
+	if len(tiers) == 0 {
+		tiers = []string{"none"}
+	}
+
+	maxID := "off"
+	if s.MaxRefereeID > 0 {
+		maxID = strconv.FormatInt(s.MaxRefereeID, 10)
+	}
+
+	captcha := "off"
+	if s.Captcha {
+		captcha = "on"
+	}
+
+	milestones := make([]string, len(s.Milestones))
+	for i, m := range s.Milestones {
+		milestones[i] = fmt.Sprintf("%d: %s", m.Referrals, strconv.FormatFloat(m.Bonus, 'f', -1, 64))
+	}
+	if len(milestones) == 0 {
+		milestones = []string{"off"}
+	}
+
+	badges := make([]string, len(s.Badges))
+	for i, badge := range s.Badges {
+		badges[i] = fmt.Sprintf("%s: %d (x%s)", html.EscapeString(badge.Name), badge.Referrals, strconv.FormatFloat(badge.Multiplier, 'f', -1, 64))
+	}
+	if len(badges) == 0 {
+		badges = []string{"off"}
+	}
+
+	return fmt.Sprintf(
+		"⚙️ <b>Settings</b>\n\n"+
+			"🪙 <b>Token Name:</b> %s\n"+
+			"🤝 <b>Referral Rewards:</b> %s\n"+
+			"💱 <b>Rate:</b> 1 %s = %s %s\n"+
+			"⏳ <b>Reward Hold:</b> %d hours\n"+
+			"🆕 <b>Max Referee ID:</b> %s\n"+
+			"🤖 <b>Captcha:</b> %s\n"+
+			"🏆 <b>Milestones:</b> %s\n"+
+			"🏅 <b>Badges:</b> %s\n\n"+
+			"<b>Usage:</b>\n"+
+			"<code>/settings tiers 10,2,0.5</code>\n"+
+			"<code>/settings token &lt;name&gt;</code>\n"+
+			"<code>/settings rate &lt;value&gt; [currency]</code>\n"+
+			"<code>/settings hold &lt;hours&gt;</code>\n"+
+			"<code>/settings maxid &lt;user_id|0&gt;</code>\n"+
+			"<code>/settings captcha on|off</code>\n"+
+			"<code>/settings milestones 10:50,50:300|off</code>\n"+
+			"<code>/settings badges Bronze:10:1.1,Silver:50:1.25|off</code>",
+		html.EscapeString(s.TokenName), strings.Join(tiers, ", "),
+		html.EscapeString(s.TokenName), strconv.FormatFloat(s.FiatRate, 'f', -1, 64), html.EscapeString(s.FiatCurrency),
+		s.ReferralHoldHours, maxID, captcha, strings.Join(milestones, ", "), strings.Join(badges, ", "))
+}
+
+func (a *app) settingsCmd(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	user := ctx.EffectiveUser
+	if user.Id != OwnerID {
+		_, _ = msg.Reply(b, "❌ You are not authorized to use this command.", nil)
+		return nil
+	}
+
+	s := settings()
+	args := ctx.Args()[1:]
+	if len(args) < 2 {
+		_, _ = msg.Reply(b, settingsText(s), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "tiers":
+		tiers, err := parseReferralTiers(strings.Join(args[1:], ""))
+		if err != nil {
+			_, _ = msg.Reply(b, "❌ Invalid tiers: "+err.Error(), nil)
+			return nil
+		}
+		s.ReferralTiers = tiers
+
+	case "token":
+		name := strings.Join(args[1:], " ")
+		if strings.ContainsAny(name, htmlSpecialChars) {
+			_, _ = msg.Reply(b, "❌ The token name can't contain <, > or &.", nil)
+			return nil
+		}
+		s.TokenName = name
+
+	case "rate":
+		rate, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || rate < 0 {
+			_, _ = msg.Reply(b, "❌ The rate must be a number of at least zero.", nil)
+			return nil
+		}
+		s.FiatRate = rate
+		if len(args) > 2 {
+			if strings.ContainsAny(args[2], htmlSpecialChars) {
+				_, _ = msg.Reply(b, "❌ The currency can't contain <, > or &.", nil)
+				return nil
+			}
+			s.FiatCurrency = strings.ToUpper(args[2])
+		}
+
+	case "hold":
+		hours, err := strconv.Atoi(args[1])
+		if err != nil || hours < 0 {
+			_, _ = msg.Reply(b, "❌ The hold must be a whole number of hours.", nil)
+			return nil
+		}
+		s.ReferralHoldHours = hours
+
+	case "maxid":
+		maxID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || maxID < 0 {
+			_, _ = msg.Reply(b, "❌ The max referee ID must be a user ID, or 0 to turn the check off.", nil)
+			return nil
+		}
+		s.MaxRefereeID = maxID
+
+	case "captcha":
+		switch strings.ToLower(args[1]) {
+		case "on":
+			s.Captcha = true
+		case "off":
+			s.Captcha = false
+		default:
+			_, _ = msg.Reply(b, "❌ Use <code>/settings captcha on</code> or <code>off</code>.", &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+			return nil
+		}
+
+	case "milestones":
+		s.Milestones = nil
+		if strings.ToLower(args[1]) != "off" {
+			milestones, err := parseMilestones(strings.Join(args[1:], ""))
+			if err != nil {
+				_, _ = msg.Reply(b, "❌ Invalid milestones: "+err.Error(), nil)
+				return nil
+			}
+			s.Milestones = milestones
+		}
+
+	case "badges":
+		s.Badges = nil
+		if strings.ToLower(args[1]) != "off" {
+			badges, err := parseBadges(strings.Join(args[1:], ""))
+			if err != nil {
+				_, _ = msg.Reply(b, "❌ Invalid badges: "+err.Error(), nil)
+				return nil
+			}
+			s.Badges = badges
+		}
+
+	default:
+		_, _ = msg.Reply(b, settingsText(s), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+		return nil
+	}
+
+	s.UpdatedBy = user.Id
+	s.UpdatedAt = time.Now()
+	if err := a.store.SaveSettings(s); err != nil {
+		_, _ = msg.Reply(b, "❌ Failed to save settings.\n\n"+CustomError(err).Error(), nil)
+		return err
+	}
+	setSettings(s)
+
+	_, _ = msg.Reply(b, "✅ Settings saved.\n\n"+settingsText(s), &gotgbot.SendMessageOpts{ParseMode: "HTML"})
+	return nil
+}
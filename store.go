@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// User represents the structure of a user document in MongoDB
+type User struct {
+	ID            int64   `bson:"_id,omitempty" json:"_id,omitempty"`
+	Referrer      int64   `bson:"referrer,omitempty" json:"referrer,omitempty"`
+	ReferredUsers []int64 `bson:"referred_users,omitempty" json:"referred_users,omitempty"`
+	AccNo         int64   `bson:"acc_no,omitempty" json:"acc_no,omitempty"`
+	// Balance is a cached projection of the user's transactions ledger.
+	// Use Store.RebuildBalance to recompute it.
+	Balance      float64   `bson:"balance,omitempty" json:"balance,omitempty"`
+	LastActiveAt time.Time `bson:"last_active_at,omitempty" json:"last_active_at,omitempty"`
+	// RefCode is the random code in the user's referral link, and
+	// VanityCode the custom one they claimed, if any.
+	RefCode    string `bson:"ref_code,omitempty" json:"ref_code,omitempty"`
+	VanityCode string `bson:"vanity_code,omitempty" json:"vanity_code,omitempty"`
+	// Milestones lists the referral counts the user was paid a milestone
+	// bonus for.
+	Milestones []int `bson:"milestones,omitempty" json:"milestones,omitempty"`
+	// HideFromTop keeps the user off the referral leaderboard.
+	HideFromTop bool `bson:"hide_from_top,omitempty" json:"hide_from_top,omitempty"`
+	// RewardHold is TxReferralReversal or TxReferralFreeze once the reward
+	// paid for this user was taken back because they left an fsub channel,
+	// and FrozenReward is how much a freeze holds.
+	RewardHold   string  `bson:"reward_hold,omitempty" json:"reward_hold,omitempty"`
+	FrozenReward float64 `bson:"frozen_reward,omitempty" json:"frozen_reward,omitempty"`
+}
+
+// Store is the persistence layer behind users, referrals, balances,
+// withdrawals and bot settings such as force-subscribe channels. mongoStore
+// is used in production and memoryStore in tests.
+//
+// Lookups of missing documents return mongo.ErrNoDocuments. Credits and
+// debits update the cached balance and append the ledger entry as one unit,
+// and a debit never takes a balance below zero.
+type Store interface {
+	AddUser(user User) error
+	GetUser(userID int64) (*User, error)
+	GetAllUsers() ([]User, error)
+	UpdateAccNo(userID, accNo int64) error
+	// TouchUser records that the user interacted with the bot at at.
+	TouchUser(userID int64, at time.Time) error
+	// SetRefCode and SetVanityCode return ErrCodeTaken if another user
+	// already has code in the same field.
+	SetRefCode(userID int64, code string) error
+	SetVanityCode(userID int64, code string) error
+	// UserByCode finds the user whose random or vanity code is code.
+	UserByCode(code string) (*User, error)
+	// ClaimMilestone marks the milestone of referrals as paid to the user and
+	// credits bonus in one unit. It returns mongo.ErrNoDocuments if it
+	// already was paid.
+	ClaimMilestone(userID int64, referrals int, bonus float64, entry Transaction) (*Transaction, error)
+	SetHideFromTop(userID int64, hide bool) error
+	// UsersHiddenFromTop returns the IDs of users who opted out of the
+	// leaderboard.
+	UsersHiddenFromTop() ([]int64, error)
+
+	// ReferUser registers newUserID as referred by referrerID.
+	ReferUser(referrerID, newUserID int64) error
+	// HoldReferralReward debits amount from referrerID as entry.Type, a
+	// reversal or freeze of the reward paid for refereeID, and marks the
+	// referee in the same unit. It returns mongo.ErrNoDocuments if the
+	// reward was already reversed or is frozen.
+	HoldReferralReward(refereeID, referrerID int64, amount float64, entry Transaction) (*Transaction, error)
+	// ReleaseReferralReward credits the frozen reward for refereeID back to
+	// referrerID. It returns mongo.ErrNoDocuments if none is frozen.
+	ReleaseReferralReward(refereeID, referrerID int64, entry Transaction) (*Transaction, error)
+
+	Credit(userID int64, amount float64, entry Transaction) (*Transaction, error)
+	Debit(userID int64, amount float64, entry Transaction) (*Transaction, error)
+	// RecordTransaction appends a ledger entry without touching the balance.
+	RecordTransaction(entry Transaction) (*Transaction, error)
+	Transactions(userID int64) ([]Transaction, error)
+	// RebuildBalance recomputes the cached balance from the ledger.
+	RebuildBalance(userID int64) (float64, error)
+
+	// CreateWithdrawal debits w.Amount from the user and stores w in one unit.
+	CreateWithdrawal(w Withdrawal) (*Withdrawal, error)
+	GetWithdrawal(id primitive.ObjectID) (*Withdrawal, error)
+	TransitionWithdrawal(id primitive.ObjectID, to string, actorID int64, reason string) (*Withdrawal, error)
+
+	RecordAudit(entry AuditEntry) error
+
+	FSubChannels() ([]FSubChannel, error)
+	AddFSubChannel(ch FSubChannel) error
+	RemoveFSubChannel(chatID int64) error
+
+	RecordMembershipEvent(event MembershipEvent) error
+	MembershipEvents(userID int64) ([]MembershipEvent, error)
+
+	SaveInviteLink(invite ReferralInvite) error
+	InviteLink(link string) (*ReferralInvite, error)
+	// FindInviteLink returns the link for chatID owned by ownerID or campaign.
+	FindInviteLink(chatID, ownerID int64, campaign string, joinRequest bool) (*ReferralInvite, error)
+	InviteLinksByOwner(ownerID int64) ([]ReferralInvite, error)
+	IncrementInviteJoins(link string) error
+
+	// SaveJoinRequest stores req, replacing an earlier request to the same chat.
+	SaveJoinRequest(req JoinRequest) error
+	JoinRequest(chatID, userID int64) (*JoinRequest, error)
+	DeleteJoinRequest(chatID, userID int64) error
+
+	CreateReferral(r Referral) (*Referral, error)
+	GetReferral(id primitive.ObjectID) (*Referral, error)
+	// TransitionReferral moves a referral from one status to another. It
+	// returns mongo.ErrNoDocuments if the referral is no longer in from.
+	TransitionReferral(id primitive.ObjectID, from, to, reason string) error
+	// FlagReferral records the fraud score a referral was held with.
+	FlagReferral(id primitive.ObjectID, score int, signals []string) error
+	// DueReferrals returns pending referrals whose hold ends by now.
+	DueReferrals(now time.Time) ([]Referral, error)
+	ReferralsByReferrer(referrerID int64) ([]Referral, error)
+	ReferralsByStatus(status string) ([]Referral, error)
+	// ReferrerRanks counts each referrer's referrals confirmed at or after
+	// since, most referrals first.
+	ReferrerRanks(since time.Time) ([]leaderRank, error)
+
+	GetSettings() (*Settings, error)
+	SaveSettings(settings Settings) error
+
+	SaveCampaign(c Campaign) error
+	GetCampaign(code string) (*Campaign, error)
+	Campaigns() ([]Campaign, error)
+	// EndCampaign stops the campaign from accepting signups after at.
+	EndCampaign(code string, at time.Time) error
+	// RecordCampaignSignup counts a signup and the bonus paid for it. It
+	// returns mongo.ErrNoDocuments if the campaign isn't accepting signups.
+	RecordCampaignSignup(code string, bonus float64, now time.Time) (*Campaign, error)
+
+	// RecordCaptchaFailure counts a failed captcha and returns the updated tally.
+	RecordCaptchaFailure(userID int64, at time.Time) (*CaptchaFailure, error)
+	CaptchaFailures(userID int64) (*CaptchaFailure, error)
+}
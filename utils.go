@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 )
@@ -39,3 +41,56 @@ func onlyInt64(msg *gotgbot.Message) bool {
 		return false
 	}
 }
+
+// parseBool parses an optional boolean setting; an empty string is false.
+func parseBool(s string) (bool, error) {
+	if strings.TrimSpace(s) == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(strings.TrimSpace(s))
+}
+
+// parseInt64List parses a comma-separated list of integers, ignoring blanks.
+func parseInt64List(s string) ([]int64, error) {
+	var ids []int64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q: %v", part, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseFloat64List parses a comma-separated list of numbers, ignoring blanks.
+func parseFloat64List(s string) ([]float64, error) {
+	var values []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q: %v", part, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func containsInt64(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stubBotClient answers every Bot API call with a generic message.
+type stubBotClient struct{}
+
+func (stubBotClient) RequestWithContext(context.Context, string, string, map[string]string, map[string]gotgbot.FileReader, *gotgbot.RequestOpts) (json.RawMessage, error) {
+	return json.RawMessage(`{"message_id":1,"date":0,"chat":{"id":1,"type":"private"}}`), nil
+}
+
+func (stubBotClient) GetAPIURL(*gotgbot.RequestOpts) string {
+	return gotgbot.DefaultAPIURL
+}
+
+func (stubBotClient) FileURL(string, string, *gotgbot.RequestOpts) string {
+	return ""
+}
+
+func TestConcurrentWithdrawalsNeverOverdraw(t *testing.T) {
+	const (
+		userID    = int64(42)
+		balance   = 100.0
+		amount    = 10.0
+		attempts  = 64
+		maxPayout = int(balance / amount)
+	)
+
+	mem := newMemoryStore(User{ID: userID, AccNo: 1234, Balance: balance})
+	a := newApp(mem)
+
+	b := &gotgbot.Bot{Token: "1:test", BotClient: stubBotClient{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from := &gotgbot.User{Id: userID, FirstName: "Test"}
+			update := &gotgbot.Update{Message: &gotgbot.Message{
+				MessageId: int64(i),
+				From:      from,
+				Chat:      gotgbot.Chat{Id: userID, Type: "private"},
+				Text:      "10",
+			}}
+			_ = a.withdrawalAsk(b, ext.NewContext(b, update, nil))
+		}(i)
+	}
+	wg.Wait()
+
+	user, err := mem.GetUser(userID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.Balance != 0 {
+		t.Fatalf("balance = %.2f, want 0", user.Balance)
+	}
+
+	var debits int
+	for _, tx := range mem.txs {
+		if tx.Type != TxWithdrawal {
+			continue
+		}
+		debits++
+		if tx.BalanceAfter < 0 {
+			t.Fatalf("ledger entry went negative: %+v", tx)
+		}
+	}
+	if debits != maxPayout {
+		t.Fatalf("recorded %d withdrawals, want %d", debits, maxPayout)
+	}
+
+	if _, err := a.debitBalance(userID, amount, TxWithdrawal, userID, ""); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("debit on empty balance: err = %v, want ErrInsufficientBalance", err)
+	}
+}
+
+func TestWithdrawalButtonsFitCallbackLimit(t *testing.T) {
+	w := &Withdrawal{ID: primitive.NewObjectID(), UserID: math.MaxInt64, Status: WithdrawalPending}
+	markups := []interface{}{withdrawalMarkup(w), cancelMarkup(w)}
+	w.Status = WithdrawalApproved
+	markups = append(markups, withdrawalMarkup(w))
+
+	for _, markup := range markups {
+		data, err := json.Marshal(markup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCallbackData(string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
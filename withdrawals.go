@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Withdrawal states. A request starts pending and moves to approved and then
+// paid, or ends early as rejected or cancelled.
+const (
+	WithdrawalPending   = "pending"
+	WithdrawalApproved  = "approved"
+	WithdrawalPaid      = "paid"
+	WithdrawalRejected  = "rejected"
+	WithdrawalCancelled = "cancelled"
+)
+
+// withdrawalTransitions maps each target state to the states it may be reached from.
+var withdrawalTransitions = map[string][]string{
+	WithdrawalApproved:  {WithdrawalPending},
+	WithdrawalPaid:      {WithdrawalApproved},
+	WithdrawalRejected:  {WithdrawalPending, WithdrawalApproved},
+	WithdrawalCancelled: {WithdrawalPending},
+}
+
+// refundStates are the states that return the withdrawn amount to the user.
+var refundStates = map[string]bool{
+	WithdrawalRejected:  true,
+	WithdrawalCancelled: true,
+}
+
+// pendingRejection remembers which logger message to update once the admin
+// has sent the rejection reason.
+type pendingRejection struct {
+	withdrawalID string
+	chatID       int64
+	messageID    int64
+}
+
+var ErrInvalidTransition = errors.New("invalid withdrawal state transition")
+
+// WithdrawalEvent is one state change in a withdrawal's history.
+type WithdrawalEvent struct {
+	Status  string    `bson:"status" json:"status"`
+	ActorID int64     `bson:"actor_id" json:"actor_id"`
+	Reason  string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	At      time.Time `bson:"at" json:"at"`
+}
+
+// Withdrawal is a persisted payout request. AccNo and UserName are snapshots
+// taken when the request was made, so later profile edits don't change where
+// an already requested payout goes.
+type Withdrawal struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID     int64              `bson:"user_id" json:"user_id"`
+	UserName   string             `bson:"user_name,omitempty" json:"user_name,omitempty"`
+	Amount     float64            `bson:"amount" json:"amount"`
+	AccNo      int64              `bson:"acc_no" json:"acc_no"`
+	Status     string             `bson:"status" json:"status"`
+	DebitTxID  primitive.ObjectID `bson:"debit_tx_id,omitempty" json:"debit_tx_id,omitempty"`
+	RefundTxID primitive.ObjectID `bson:"refund_tx_id,omitempty" json:"refund_tx_id,omitempty"`
+	ActedBy    int64              `bson:"acted_by,omitempty" json:"acted_by,omitempty"`
+	Reason     string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	History    []WithdrawalEvent  `bson:"history,omitempty" json:"history,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range withdrawalTransitions[to] {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// createWithdrawal debits the user's balance and stores a pending withdrawal
+// for it as one unit.
+func (a *app) createWithdrawal(userID int64, userName string, amount float64, accNo int64) (*Withdrawal, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount to withdraw must be greater than zero")
+	}
+
+	now := time.Now()
+	return a.store.CreateWithdrawal(Withdrawal{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		UserName:  userName,
+		Amount:    amount,
+		AccNo:     accNo,
+		Status:    WithdrawalPending,
+		History:   []WithdrawalEvent{{Status: WithdrawalPending, ActorID: userID, At: now}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+}
+
+func (a *app) getWithdrawal(id string) (*Withdrawal, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid withdrawal ID %q", id)
+	}
+	return a.store.GetWithdrawal(oid)
+}
+
+// transitionWithdrawal moves a withdrawal to the given state if the state
+// machine allows it, failing with ErrInvalidTransition otherwise. Moving to a
+// refund state credits the amount back to the user in the same unit.
+func (a *app) transitionWithdrawal(id string, to string, actorID int64, reason string) (*Withdrawal, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid withdrawal ID %q", id)
+	}
+	if _, ok := withdrawalTransitions[to]; !ok {
+		return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidTransition, to)
+	}
+	return a.store.TransitionWithdrawal(oid, to, actorID, reason)
+}
+
+func withdrawalText(w *Withdrawal) string {
+	text := fmt.Sprintf(
+		"💰 <b>%s</b> requested a withdrawal of %s\n\n"+
+			"🆔 <b>Request:</b> <code>%s</code>\n"+
+			"👤 <b>User ID:</b> <code>%d</code>\n"+
+			"User AccNo: <code>%d</code>\n"+
+			"📌 <b>Status:</b> %s",
+		html.EscapeString(w.UserName), formatAmountFiat(w.Amount), w.ID.Hex(), w.UserID, w.AccNo, w.Status)
+
+	if w.Reason != "" {
+		text += fmt.Sprintf("\n📝 <b>Reason:</b> %s", html.EscapeString(w.Reason))
+	}
+	return text
+}
+
+// withdrawalMarkup returns the admin actions available in the withdrawal's
+// current state, or nil once it has reached a final state.
+func withdrawalMarkup(w *Withdrawal) *gotgbot.InlineKeyboardMarkup {
+	reject := gotgbot.InlineKeyboardButton{
+		Text:         "❌ Reject",
+		CallbackData: signCallback("reject_withdrawal."+w.ID.Hex(), 0),
+	}
+
+	switch w.Status {
+	case WithdrawalPending:
+		return &gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+				{
+					{
+						Text:         "✅ Confirm Withdrawal",
+						CallbackData: signCallback("confirm_withdrawal."+w.ID.Hex(), 0),
+					},
+					reject,
+				},
+			},
+		}
+	case WithdrawalApproved:
+		return &gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{
+				{
+					{
+						Text:         "💸 Mark as Paid",
+						CallbackData: signCallback("paid_withdrawal."+w.ID.Hex(), 0),
+					},
+					reject,
+				},
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+// cancelMarkup lets the user cancel the request while no admin has acted on
+// it. The user ID is left out to stay within the callback data limit;
+// cancelWithdrawal checks the presser against the stored request instead.
+func cancelMarkup(w *Withdrawal) gotgbot.InlineKeyboardMarkup {
+	return gotgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{{
+			Text:         "🚫 Cancel Request",
+			CallbackData: signCallback("cancel_withdrawal."+w.ID.Hex(), userCallbackTTL),
+		}}},
+	}
+}
+
+func (a *app) setPendingRejection(adminID int64, p pendingRejection) {
+	a.pendingRejectionsMu.Lock()
+	defer a.pendingRejectionsMu.Unlock()
+	a.pendingRejections[adminID] = p
+}
+
+func (a *app) takePendingRejection(adminID int64) (pendingRejection, bool) {
+	a.pendingRejectionsMu.Lock()
+	defer a.pendingRejectionsMu.Unlock()
+	id, ok := a.pendingRejections[adminID]
+	delete(a.pendingRejections, adminID)
+	return id, ok
+}